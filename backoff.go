@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMountRetryInterval = 5 * time.Second
+	maxMountRetryInterval     = time.Minute
+)
+
+// Exponential backoff with jitter.
+// Nodes waiting for the same volume spread out instead of polling in lockstep.
+type backoff struct {
+	next   time.Duration
+	max    time.Duration
+	random *rand.Rand
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		next:   initial,
+		max:    max,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Returns the next delay, somewhere between half and all of the current interval,
+// and doubles the interval up to the maximum.
+func (backoff *backoff) delay() time.Duration {
+	current := backoff.next
+
+	backoff.next *= 2
+	if backoff.next > backoff.max {
+		backoff.next = backoff.max
+	}
+
+	half := current / 2
+	if half <= 0 {
+		return current
+	}
+
+	return half + time.Duration(backoff.random.Int63n(int64(half)+1))
+}
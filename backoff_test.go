@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDoublesUpToTheMaximum(t *testing.T) {
+	backoff := newBackoff(time.Second, 5*time.Second)
+
+	for _, interval := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := backoff.delay(); delay < interval/2 || delay > interval {
+			t.Fatalf("Delay %s is not between half and all of %s", delay, interval)
+		}
+	}
+}
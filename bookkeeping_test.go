@@ -0,0 +1,165 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+// Records the volume events that were logged
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events map[string][]string
+}
+
+var (
+	recordedEvents = &eventRecorder{events: make(map[string][]string)}
+	recordEvents   sync.Once
+)
+
+func (recorder *eventRecorder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (recorder *eventRecorder) Fire(entry *log.Entry) error {
+	event, ok := entry.Data["event"].(string)
+	if !ok {
+		return nil
+	}
+	volume, _ := entry.Data["volume"].(string)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.events[volume] = append(recorder.events[volume], event)
+	return nil
+}
+
+// Returns the events of the volume logged since the last call
+func (recorder *eventRecorder) take(volume string) []string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	events := recorder.events[volume]
+	delete(recorder.events, volume)
+	return events
+}
+
+func startRecordingEvents(volume string) {
+	recordEvents.Do(func() { log.AddHook(recordedEvents) })
+	recordedEvents.take(volume)
+}
+
+func expectEvents(t *testing.T, volume string, expected ...string) {
+	events := recordedEvents.take(volume)
+	if len(events) != len(expected) {
+		t.Fatalf("Events %v were logged for volume %s, expected %v", events, volume, expected)
+	}
+	for i := range events {
+		if events[i] != expected[i] {
+			t.Fatalf("Events %v were logged for volume %s, expected %v", events, volume, expected)
+		}
+	}
+}
+
+func TestBookkeepingDropsRemovedVolume(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	startRecordingEvents("data")
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data")
+
+	// Another node removed the volume
+	if err := os.RemoveAll(volume.Mountpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data", volumeEventRemoved)
+
+	if _, ok := driver.getVolume("data"); ok {
+		t.Fatal("Removed volume was kept in the bookkeeping")
+	}
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data")
+}
+
+func TestBookkeepingReplacesRecreatedVolume(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	startRecordingEvents("data")
+
+	driver := newTestDriver()
+	old := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(old)
+
+	// Another node removed the volume and created it again
+	setTestHost(t, "h2")
+	if err := os.RemoveAll(old.Mountpoint); err != nil {
+		t.Fatal(err)
+	}
+	recreated := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+
+	setTestHost(t, "h1")
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data", volumeEventRecreated)
+
+	volume, ok := driver.getVolume("data")
+	if !ok {
+		t.Fatal("Recreated volume was dropped from the bookkeeping")
+	}
+	if volume == old || volume.UUID != recreated.UUID || !volume.Exclusive {
+		t.Fatalf("Bookkeeping still holds the removed volume %s", volume.UUID)
+	}
+	if lock, err := volume.getLock("h1"); err != nil || lock == nil {
+		t.Fatalf("Recreated volume was not locked: %v", err)
+	}
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data")
+}
+
+func TestBookkeepingFollowsChangedOptions(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	startRecordingEvents("data")
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	// The owner changes with every mount, that is no change of the options
+	other := attachTestVolume(t, "data")
+	if err := other.changeMetadata(func(metadata *volumeMetadata) { metadata.Owner = "h2" }); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data")
+
+	if err := other.changeMetadata(func(metadata *volumeMetadata) { metadata.Protected = true }); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.ReconcileBookkeeping()
+	expectEvents(t, "data", volumeEventChanged)
+
+	if current, _ := driver.getVolume("data"); current != volume {
+		t.Fatal("Volume with changed options was replaced in the bookkeeping")
+	}
+
+	response, err := driver.Get(&dockerVolume.GetRequest{Name: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Volume.Status["protected"] != true {
+		t.Errorf("Changed options were not loaded into the bookkeeping: %v", response.Volume.Status)
+	}
+}
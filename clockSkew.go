@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Estimated difference between the clock of the lock owner and the clock of the shared filesystem,
+// based on the timestamp written into the lock file and the modification time assigned by the server.
+// Positive values mean the owner is ahead. Timestamps only have a resolution of a second.
+func (lock *volumeLock) skew() time.Duration {
+	return lock.lockedTime.Sub(lock.modTime.Truncate(time.Second))
+}
+
+// Returns an error if the clocks of this node and the lock owner are too far apart
+// to trust the age of the lock. Only relevant when lock ages depend on timestamps.
+func (volume *sharedVolume) checkClockSkew(lock *volumeLock) error {
+	if maxClockSkew <= 0 || leaseMode != leaseModeTimestamp {
+		return nil
+	}
+
+	// The age is calculated with our own clock, so the skew relative to us is what matters
+	skew := lock.skew()
+	if ownLock, err := volume.getLock(*hostname); err == nil && ownLock != nil {
+		skew -= ownLock.skew()
+	}
+
+	if absDuration(skew) > maxClockSkew {
+		return fmt.Errorf("Refusing to take over volume %s from host %s: clock skew of %s exceeds %s", volume.Name, lock.hostname, skew, maxClockSkew)
+	}
+
+	return nil
+}
+
+// Returns the clock skew of every host holding a lock on the volume
+func (volume *sharedVolume) getClockSkews() map[string]string {
+	skews := make(map[string]string)
+
+	for host, lock := range volume.getLocks() {
+		if lock != nil {
+			skews[host] = lock.skew().String()
+		}
+	}
+
+	return skews
+}
+
+// Estimates the clock skew of every host from the lock files of all known volumes
+// and logs the hosts that are above the configured bound.
+func (driver sharedVolumeDriver) CheckClockSkew() {
+	samples := make(map[string][]time.Duration)
+
+	for _, volume := range driver.snapshot() {
+		volume.mutex.Lock()
+		for host, lock := range volume.getLocks() {
+			if lock != nil {
+				samples[host] = append(samples[host], lock.skew())
+			}
+		}
+		volume.mutex.Unlock()
+	}
+
+	for host, hostSamples := range samples {
+		skew := medianDuration(hostSamples)
+
+		if maxClockSkew > 0 && absDuration(skew) > maxClockSkew {
+			log.Warnf("Clock of host %s is off by %s compared to the shared filesystem (bound is %s)", host, skew, maxClockSkew)
+		} else {
+			log.Debugf("Clock of host %s is off by %s compared to the shared filesystem", host, skew)
+		}
+	}
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
+
+func absDuration(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return -duration
+	}
+	return duration
+}
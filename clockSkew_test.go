@@ -0,0 +1,115 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Rewrites the lock file of the host as if it was last refreshed age ago.
+// If skewed, the modification time is left alone, as if the clock of the host was behind.
+func ageTestLock(t *testing.T, volume *sharedVolume, host string, age time.Duration, skewed bool) {
+	lockFile := volume.GetLockFileFor(host)
+
+	contents, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := parseLockRecord(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed := time.Now().Add(-age)
+	record.Timestamp = refreshed.UTC().Format(time.RFC3339)
+
+	if contents, err = json.Marshal(record); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(lockFile, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !skewed {
+		if err = os.Chtimes(lockFile, refreshed, refreshed); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCleanupKeepsLocksOfSkewedHosts(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock of h1 is five minutes behind, so its lock only looks stale
+	ageTestLock(t, volume, "h1", 5*time.Minute, true)
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	locking.cleanup(other)
+
+	if !exists(other.GetLockFileFor("h1")) {
+		t.Error("Lock of a host with a skewed clock was removed")
+	}
+	if !exists(other.getExclusiveMountFile()) {
+		t.Error("Mount of a host with a skewed clock was removed")
+	}
+}
+
+func TestCleanupRemovesTimedOutLocks(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ageTestLock(t, volume, "h1", 5*time.Minute, false)
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	locking.cleanup(other)
+
+	if exists(other.GetLockFileFor("h1")) {
+		t.Error("Timed out lock was not removed")
+	}
+	if exists(other.getExclusiveMountFile()) {
+		t.Error("Mount of a timed out host was not removed")
+	}
+}
+
+func TestCleanupUsesTheLockTimeoutOfTheVolume(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, LockTimeout: 600})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timed out for the driver, but not for the volume
+	ageTestLock(t, volume, "h1", 5*time.Minute, false)
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	locking.cleanup(other)
+
+	if !exists(other.GetLockFileFor("h1")) || !exists(other.getExclusiveMountFile()) {
+		t.Fatal("Lock was removed before the lock timeout of the volume")
+	}
+
+	ageTestLock(t, volume, "h1", 11*time.Minute, false)
+	locking.cleanup(other)
+
+	if exists(other.GetLockFileFor("h1")) || exists(other.getExclusiveMountFile()) {
+		t.Error("Lock was kept after the lock timeout of the volume")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// A minimal client for the local Docker Engine API,
+// used to find out which containers are using our volumes.
+type dockerEngine struct {
+	socket string
+	client *http.Client
+}
+
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Names  []string
+	State  string
+	Labels map[string]string
+	Mounts []dockerContainerMount
+}
+
+type dockerContainerMount struct {
+	Type   string
+	Name   string
+	Driver string
+	RW     bool
+}
+
+// The engine used by the driver, nil if disabled
+var engine *dockerEngine
+
+func newDockerEngine(socket string) *dockerEngine {
+	if socket == "" {
+		return nil
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &dockerEngine{
+		socket: socket,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+	}
+}
+
+// Lists the containers matching the filters.
+// Stopped containers are only included if all is set.
+func (engine *dockerEngine) listContainers(filters map[string][]string, all bool) ([]dockerContainer, error) {
+	return engine.listContainersContext(context.Background(), filters, all)
+}
+
+// Lists the containers matching the filters, giving up once the context is done
+func (engine *dockerEngine) listContainersContext(ctx context.Context, filters map[string][]string, all bool) ([]dockerContainer, error) {
+	if engine == nil {
+		return nil, fmt.Errorf("Docker engine access is disabled")
+	}
+
+	encodedFilters, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("filters", string(encodedFilters))
+	if all {
+		query.Set("all", "1")
+	}
+
+	// The host is ignored, the connection always goes to the socket
+	request, err := http.NewRequest("GET", "http://docker/containers/json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := engine.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Docker engine returned %s", response.Status)
+	}
+
+	containers := []dockerContainer{}
+	if err = json.NewDecoder(response.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+// Returns the running containers on this host that use any of the volumes
+func (engine *dockerEngine) runningContainers(ctx context.Context, volumeNames []string) ([]dockerContainer, error) {
+	return engine.listContainersContext(ctx, map[string][]string{
+		"volume": volumeNames,
+		"status": {"running"},
+	}, false)
+}
+
+// Returns the IDs of the containers on this host that have the volume attached
+func (engine *dockerEngine) attachedContainers(volumeName string) (map[string]bool, error) {
+	containers, err := engine.listContainers(map[string][]string{
+		"volume": {volumeName},
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	attached := make(map[string]bool)
+	for _, container := range containers {
+		if attachedContainerStates[container.State] {
+			attached[container.ID] = true
+		}
+	}
+
+	return attached, nil
+}
+
+// Stops a container, killing it if it does not stop within the timeout.
+// Gives up waiting once the context is done.
+func (engine *dockerEngine) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	if engine == nil {
+		return fmt.Errorf("Docker engine access is disabled")
+	}
+
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(int(timeout.Seconds())))
+
+	// The request lasts as long as the container takes to stop
+	client := *engine.client
+	client.Timeout += timeout
+
+	request, err := http.NewRequest("POST", "http://docker/containers/"+url.PathEscape(id)+"/stop?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Not modified means the container was already stopped
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified {
+		return fmt.Errorf("Docker engine returned %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves the parts of the Docker Engine API the driver uses on a local unix socket
+type fakeEngine struct {
+	mutex      *sync.Mutex
+	containers []dockerContainer
+	// How long stopping a container takes
+	stopDelay time.Duration
+}
+
+// Starts a fake engine and points the driver at it.
+// The returned function stops it again.
+func startFakeEngine(t *testing.T) (*fakeEngine, func()) {
+	dir, err := ioutil.TempDir("", "sharedfs-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	fake := &fakeEngine{mutex: &sync.Mutex{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", fake.listContainers)
+	mux.HandleFunc("/containers/", fake.stopContainer)
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = listener
+	server.Start()
+
+	engine = newDockerEngine(socket)
+
+	return fake, func() {
+		engine = nil
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Adds a container using the volumes to the engine
+func (fake *fakeEngine) addContainer(id string, state string, volumes ...string) dockerContainer {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	container := dockerContainer{
+		ID:     id,
+		Names:  []string{"/" + id},
+		State:  state,
+		Labels: map[string]string{},
+	}
+	for _, name := range volumes {
+		container.Mounts = append(container.Mounts, dockerContainerMount{Type: "volume", Name: name, Driver: "sharedfs", RW: true})
+	}
+
+	fake.containers = append(fake.containers, container)
+	return container
+}
+
+func (fake *fakeEngine) setState(id string, state string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	for i := range fake.containers {
+		if fake.containers[i].ID == id {
+			fake.containers[i].State = state
+		}
+	}
+}
+
+func (fake *fakeEngine) state(id string) string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	for _, container := range fake.containers {
+		if container.ID == id {
+			return container.State
+		}
+	}
+
+	return ""
+}
+
+func (fake *fakeEngine) setLabel(id string, key string, value string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	for i := range fake.containers {
+		if fake.containers[i].ID == id {
+			fake.containers[i].Labels[key] = value
+		}
+	}
+}
+
+func (fake *fakeEngine) listContainers(writer http.ResponseWriter, request *http.Request) {
+	filters := map[string][]string{}
+	if value := request.URL.Query().Get("filters"); value != "" {
+		if err := json.Unmarshal([]byte(value), &filters); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	all := request.URL.Query().Get("all") == "1"
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	containers := []dockerContainer{}
+	for _, container := range fake.containers {
+		if !all && container.State != "running" {
+			continue
+		}
+		if !matchesFilter(filters["status"], container.State) {
+			continue
+		}
+
+		usesVolume := len(filters["volume"]) == 0
+		for _, mount := range container.Mounts {
+			if matchesFilter(filters["volume"], mount.Name) {
+				usesVolume = true
+			}
+		}
+
+		if usesVolume {
+			containers = append(containers, container)
+		}
+	}
+
+	json.NewEncoder(writer).Encode(containers)
+}
+
+func (fake *fakeEngine) stopContainer(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" || !strings.HasSuffix(request.URL.Path, "/stop") {
+		http.NotFound(writer, request)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/containers/"), "/stop")
+
+	fake.mutex.Lock()
+	delay := fake.stopDelay
+	fake.mutex.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-request.Context().Done():
+		return
+	}
+
+	fake.setState(id, "exited")
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// An empty filter matches everything
+func matchesFilter(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,9 +5,10 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,11 +17,20 @@ import (
 	dockerVolume "github.com/docker/go-plugins-helpers/volume"
 )
 
+// Volume and group names follow the rules of Docker volume names
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 type sharedVolumeDriver struct {
 	volumes  map[string]*sharedVolume
-	mutex    *sync.Mutex
+	mutex    *sync.RWMutex
 	root     string
 	hostname string
+	conflict *hostnameConflict
+	stop     chan struct{}
+	// Done once the background routines returned
+	routines *sync.WaitGroup
+	// Handover requests already handled, only used by the maintenance
+	handovers map[string]string
 }
 
 func newSharedFSDriver(root string) sharedVolumeDriver {
@@ -28,15 +38,22 @@ func newSharedFSDriver(root string) sharedVolumeDriver {
 
 	driver := sharedVolumeDriver{
 		volumes:  make(map[string]*sharedVolume),
-		mutex:    &sync.Mutex{},
+		mutex:    &sync.RWMutex{},
 		root:     root,
 		hostname: hostname,
+		conflict: newHostnameConflict(),
+		stop:     make(chan struct{}),
+		routines: &sync.WaitGroup{},
+
+		handovers: make(map[string]string),
 	}
 
 	// Discover volumes that are already in use by the current node
 	driver.Discover()
 
+	driver.routines.Add(2)
 	go driver.MaintenanceRoutine()
+	go driver.ReconcileRoutine()
 
 	return driver
 }
@@ -54,12 +71,8 @@ func (driver sharedVolumeDriver) Create(request *dockerVolume.CreateRequest) err
 
 	log.Infof("Create: %s, %v", request.Name, request.Options)
 
-	// Concurrency lock
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
-
 	// Is this volume already registered?
-	if _, ok := driver.volumes[request.Name]; ok {
+	if _, ok := driver.getVolume(request.Name); ok {
 
 		// Path exists and it is already part of the bookkeeping
 		message := fmt.Sprintf("Volume %s already exists.", request.Name)
@@ -69,8 +82,11 @@ func (driver sharedVolumeDriver) Create(request *dockerVolume.CreateRequest) err
 	}
 
 	// Register a new volume
-	volume := driver.newVolume(request.Name, request.Options)
-	var err error
+	volume, err := driver.newVolume(request.Name, request.Options)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 
 	// Does the volume exist already?
 	if err = volume.loadMetadata(); os.IsNotExist(err) {
@@ -94,25 +110,89 @@ func (driver sharedVolumeDriver) Create(request *dockerVolume.CreateRequest) err
 		return err
 	}
 
+	if err = volume.joinGroup(); err != nil {
+		return err
+	}
+
 	// Try to lock the volume
 	if err := volume.lock(); err != nil {
 		// If the volume cannot be locked, we risk that other nodes may delete it
 		return err
 	}
 
-	// Register in internal bookkeeping
-	driver.volumes[request.Name] = volume
+	// Register in internal bookkeeping, unless a concurrent create was faster
+	if driver.addVolume(volume) != volume {
+		log.Warningf("Volume %s already exists.", request.Name)
+		return nil
+	}
 
 	if *debug {
-		spew.Dump(driver.volumes)
+		spew.Dump(driver.snapshot())
 	}
 
 	return nil
 }
 
+// Returns the volume from the bookkeeping, or reads it from the root
+// without adding it to the bookkeeping
+func (driver sharedVolumeDriver) lookupVolume(name string) (*sharedVolume, bool) {
+	if volume, ok := driver.getVolume(name); ok {
+		return volume, true
+	}
+
+	volume, err := readVolume(name)
+
+	return volume, err == nil
+}
+
+// Returns the volume from the bookkeeping. A volume that is only found in the root,
+// for example because it was created on another node, is locked and added to it.
+func (driver sharedVolumeDriver) attachVolume(name string) (*sharedVolume, error) {
+	if volume, ok := driver.getVolume(name); ok {
+		return volume, nil
+	}
+
+	volume, err := readVolume(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = volume.lock(); err != nil {
+		return nil, fmt.Errorf("Failed to lock volume %s: %s", name, err)
+	}
+
+	// A concurrent call may have attached it already, the lock file is the same
+	if registered := driver.addVolume(volume); registered != volume {
+		return registered, nil
+	}
+	log.Infof("Attached volume %s created by another node", name)
+
+	return volume, nil
+}
+
+// Reads a volume from the root. Any directory with valid metadata is a volume.
+func readVolume(name string) (*sharedVolume, error) {
+	if !volumeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("Invalid volume name %s", name)
+	}
+
+	volume := &sharedVolume{
+		Volume: &dockerVolume.Volume{
+			Name:       name,
+			Mountpoint: filepath.Join(*root, name),
+		},
+	}
+
+	if err := volume.loadMetadata(); err != nil {
+		return nil, fmt.Errorf("Volume %s does not exist: %s", name, err)
+	}
+
+	return volume, nil
+}
+
 func (driver sharedVolumeDriver) Discover() {
 	// Look for existing volumes
-	if files, err := ioutil.ReadDir(*root); err == nil {
+	if files, err := fsReadDir(*root); err == nil {
 		for _, file := range files {
 
 			filename := file.Name()
@@ -122,8 +202,13 @@ func (driver sharedVolumeDriver) Discover() {
 				continue
 			}
 
+			if strings.HasPrefix(filename, "_") {
+				// Reserved for the driver, like the group directories
+				continue
+			}
+
 			// Is this volume registered in bookkeeping already?
-			if volume, ok := driver.volumes[filename]; !ok {
+			if volume, ok := driver.getVolume(filename); !ok {
 
 				// Try to load the volume information
 				volume = &sharedVolume{
@@ -140,12 +225,18 @@ func (driver sharedVolumeDriver) Discover() {
 
 				} else {
 
+					// Tells the mounts of a previous run apart from those of another node with our hostname
+					ownLock, err := volume.getLock(*hostname)
+					if err != nil {
+						log.Warnf("Failed to read the lock of volume %s: %s", volume.Name, err)
+					}
+
 					// If there is a lockfile add it to bookkeeping
 					if volume.hasLockfile() {
 
 						if err := volume.lock(); err == nil {
 
-							driver.volumes[volume.Name] = volume
+							driver.addVolume(volume)
 							log.Infof("Loaded previously attached volume %s", volume.Name)
 						} else {
 							volume.unlock()
@@ -153,12 +244,23 @@ func (driver sharedVolumeDriver) Discover() {
 						}
 					}
 
-					// Remove any mounts that belonged to us
+					// Remove any mounts that belonged to a previous run on this node
 					mounts := volume.getMounts()
 					for _, mount := range mounts {
-						if mount.Hostname == *hostname {
-							mount.remove()
+						if mount.Hostname != *hostname || !mount.owner().isPreviousIncarnation() {
+							continue
+						}
+
+						if volume.isLeftBehind(mount, ownLock) {
+							log.Infof("Removing mount %s of volume %s left behind by a previous run", mount.MountID, volume.Name)
+							volume.releaseMount(mount)
+							continue
 						}
+
+						err := fmt.Errorf("Mount %s of volume %s was made by another driver instance with hostname %s (pid %d, boot id %s, started at %s)",
+							mount.MountID, volume.Name, mount.Hostname, mount.PID, mount.BootID, mount.StartedAt)
+						log.Errorf("HOSTNAME CONFLICT: %s. Mounting is disabled until the conflict is resolved and the driver restarted.", err)
+						driver.conflict.set(err)
 					}
 				}
 			}
@@ -169,19 +271,25 @@ func (driver sharedVolumeDriver) Discover() {
 func (driver sharedVolumeDriver) Remove(request *dockerVolume.RemoveRequest) error {
 	log.Infof("Remove: %s", request.Name)
 
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
-
-	if volume, ok := driver.volumes[request.Name]; ok {
+	// Volumes created on other nodes are removed without attaching them
+	if volume, ok := driver.lookupVolume(request.Name); ok {
+		volume.mutex.Lock()
+		defer volume.mutex.Unlock()
 
 		err := volume.unlock()
 
+		removed := false
 		if err == nil {
-			err = volume.delete()
+			removed, err = volume.delete()
+		}
+
+		// A volume other hosts still use stays in its group
+		if removed {
+			volume.leaveGroup()
 		}
 
 		if err == nil {
-			delete(driver.volumes, request.Name)
+			driver.removeVolume(volume)
 		} else {
 			return err
 		}
@@ -193,7 +301,9 @@ func (driver sharedVolumeDriver) Remove(request *dockerVolume.RemoveRequest) err
 func (driver sharedVolumeDriver) Path(request *dockerVolume.PathRequest) (*dockerVolume.PathResponse, error) {
 	log.Debugf("Path: %s", request.Name)
 
-	if volume, ok := driver.volumes[request.Name]; ok {
+	if volume, ok := driver.lookupVolume(request.Name); ok {
+		volume.mutex.Lock()
+		defer volume.mutex.Unlock()
 
 		return &dockerVolume.PathResponse{
 			Mountpoint: volume.GetDataDir(),
@@ -203,21 +313,103 @@ func (driver sharedVolumeDriver) Path(request *dockerVolume.PathRequest) (*docke
 	return nil, nil
 }
 
+// Returns an error if this host may not mount the volume.
+// The volume may have been recreated since, the host policy or the owner may have been changed.
+func (volume *sharedVolume) checkMount() error {
+	if err := volume.verifyIdentity(); err != nil {
+		return err
+	}
+
+	if err := volume.loadMetadata(); err != nil {
+		return fmt.Errorf("Failed to load metadata of volume %s: %s", volume.Name, err.Error())
+	}
+
+	if err := volume.checkHostPolicy(*hostname); err != nil {
+		return err
+	}
+
+	return volume.checkOwner(*hostname)
+}
+
 func (driver sharedVolumeDriver) Mount(request *dockerVolume.MountRequest) (*dockerVolume.MountResponse, error) {
 	log.Infof("Mount: %s", request.Name)
 
-	if volume, ok := driver.volumes[request.Name]; ok {
+	if err := driver.conflict.get(); err != nil {
+		return nil, fmt.Errorf("Refusing to mount volume %s: %s", request.Name, err.Error())
+	}
+
+	if err := filesystem.check(); err != nil {
+		return nil, fmt.Errorf("Refusing to mount volume %s: %s", request.Name, err.Error())
+	}
+
+	// The record may have been replaced since the driver started
+	if err := checkLockBackend(lockBackendName); err != nil {
+		return nil, fmt.Errorf("Refusing to mount volume %s: %s", request.Name, err.Error())
+	}
+
+	// Volumes created on other nodes are attached on their first mount
+	volume, err := driver.attachVolume(request.Name)
+	if err == nil {
+		volume.mutex.Lock()
+		defer volume.mutex.Unlock()
 
-		if err := volume.mount(request.ID); err != nil {
+		if err := volume.checkMount(); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+
+		// Sticky volumes are claimed before they are mounted
+		claimed, err := volume.claimOwner()
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+
+		var mount *volumeMount
+		group := volume.Group
+		if group != "" {
+			// The members are locked in the order of their names
+			volume.mutex.Unlock()
+			mount, err = driver.mountGroup(volume, group, request.ID)
+			volume.mutex.Lock()
+		} else {
+			mount, err = volume.mount(request.ID)
+		}
+		if err != nil {
+			if claimed {
+				if unclaimErr := volume.unclaimOwner(); unclaimErr != nil {
+					log.Warnf("Failed to give up the owner of volume %s: %s", request.Name, unclaimErr)
+				}
+			}
 			return nil, fmt.Errorf("Failed to mount volume: %s", err.Error())
 		}
 
+		// Another host may have claimed the volume while it was mounted
+		if err := volume.verifyOwner(); err != nil {
+			log.Error(err)
+
+			if group != "" {
+				volume.mutex.Unlock()
+				err = driver.unmountGroup(volume, group, request.ID)
+				volume.mutex.Lock()
+			} else {
+				err = volume.unmount(request.ID)
+			}
+			if err != nil {
+				log.Warnf("Failed to release mount %s of volume %s: %s", request.ID, request.Name, err)
+			}
+
+			return nil, fmt.Errorf("Failed to mount volume: volume %s is owned by host %s", request.Name, volume.Owner)
+		}
+
+		volume.recordContainer(mount, nil)
+
 		return &dockerVolume.MountResponse{
-			Mountpoint: volume.GetDataDir(),
+			Mountpoint: volume.GetMountpointFor(mount),
 		}, nil
 	}
 
-	message := fmt.Sprintf("Cannot mount volume %s as it does not exist in the bookkeeping", request.Name)
+	message := fmt.Sprintf("Cannot mount volume %s: %s", request.Name, err)
 
 	log.Error(message)
 
@@ -227,9 +419,19 @@ func (driver sharedVolumeDriver) Mount(request *dockerVolume.MountRequest) (*doc
 func (driver sharedVolumeDriver) Unmount(request *dockerVolume.UnmountRequest) error {
 	log.Infof("Unmount: %s", request.Name)
 
-	if volume, ok := driver.volumes[request.Name]; ok {
-		err := volume.unmount(request.ID)
-		return err
+	if volume, ok := driver.getVolume(request.Name); ok {
+		volume.mutex.Lock()
+		group := volume.Group
+		if group == "" {
+			defer volume.mutex.Unlock()
+
+			err := volume.unmount(request.ID)
+			return err
+		}
+		volume.mutex.Unlock()
+
+		// The members are locked in the order of their names
+		return driver.unmountGroup(volume, group, request.ID)
 	}
 
 	return nil
@@ -238,7 +440,15 @@ func (driver sharedVolumeDriver) Unmount(request *dockerVolume.UnmountRequest) e
 func (driver sharedVolumeDriver) Get(request *dockerVolume.GetRequest) (*dockerVolume.GetResponse, error) {
 	log.Infof("Get: %s", request.Name)
 
-	if volume, ok := driver.volumes[request.Name]; ok {
+	if volume, ok := driver.lookupVolume(request.Name); ok {
+		volume.mutex.Lock()
+		defer volume.mutex.Unlock()
+
+		// Other nodes may have changed the fencing token since
+		if err := volume.loadMetadata(); err != nil {
+			log.Warnf("Failed to reload metadata for volume %s: %s", volume.Name, err)
+		}
+
 		responseVolume := &dockerVolume.Volume{
 			Name:       volume.Name,
 			Mountpoint: volume.GetDataDir(),
@@ -246,10 +456,62 @@ func (driver sharedVolumeDriver) Get(request *dockerVolume.GetRequest) (*dockerV
 			Status:     make(map[string]interface{}),
 		}
 
+		if volume.UUID != "" {
+			responseVolume.Status["uuid"] = volume.UUID
+			responseVolume.Status["createdBy"] = volume.CreatedBy
+		}
 		responseVolume.Status["protected"] = volume.Protected
-		responseVolume.Status["exclusive"] = volume.Exclusive
+		if volume.HostExclusive {
+			responseVolume.Status["exclusive"] = "host"
+		} else {
+			responseVolume.Status["exclusive"] = volume.Exclusive
+		}
+		responseVolume.Status["epoch"] = volume.Epoch
+
+		responseVolume.Status["lockTimeout"] = volume.lockTimeout().String()
+		if volume.MaxMounts > 0 {
+			responseVolume.Status["maxMounts"] = volume.MaxMounts
+		}
+		if queue := volume.getQueueStatus(); len(queue) > 0 {
+			responseVolume.Status["queue"] = queue
+		}
+		if len(volume.AllowedHosts) > 0 {
+			responseVolume.Status["allowedHosts"] = volume.AllowedHosts
+		}
+		if len(volume.DeniedHosts) > 0 {
+			responseVolume.Status["deniedHosts"] = volume.DeniedHosts
+		}
+		if volume.Mode != "" {
+			responseVolume.Status["mode"] = volume.Mode
+		}
+		if volume.Mode == volumeModeRWSingle {
+			writer, readers := volume.getWriterAndReaders()
+			responseVolume.Status["writer"] = writer
+			responseVolume.Status["readers"] = readers
+		}
+		if volume.Group != "" {
+			members, _ := getGroupMembers(volume.Group)
+			responseVolume.Status["group"] = volume.Group
+			responseVolume.Status["groupMembers"] = members
+		}
+		if volume.Sticky {
+			responseVolume.Status["stickyTimeout"] = volume.stickyTimeout().String()
+			responseVolume.Status["owner"] = volume.Owner
+		}
 		responseVolume.Status["locks"] = volume.getLocks()
-		responseVolume.Status["mounts"] = volume.getMounts()
+		responseVolume.Status["skew"] = volume.getClockSkews()
+
+		if err := driver.conflict.get(); err != nil {
+			responseVolume.Status["conflict"] = err.Error()
+		}
+		if state := filesystem.status(); state != "" {
+			responseVolume.Status["filesystem"] = state
+		}
+		mounts := []map[string]interface{}{}
+		for _, mount := range volume.getMounts() {
+			mounts = append(mounts, mount.status())
+		}
+		responseVolume.Status["mounts"] = mounts
 
 		return &dockerVolume.GetResponse{
 			Volume: responseVolume,
@@ -264,11 +526,26 @@ func (driver sharedVolumeDriver) List() (*dockerVolume.ListResponse, error) {
 
 	volumes := []*dockerVolume.Volume{}
 
-	for _, volume := range driver.volumes {
-		volumes = append(volumes, &dockerVolume.Volume{
-			Name:       volume.Name,
-			Mountpoint: volume.GetDataDir(),
-		})
+	// Every volume in the root, including the ones created on other nodes
+	files, err := fsReadDir(*root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		if volume, ok := driver.lookupVolume(file.Name()); ok {
+			volume.mutex.Lock()
+			volumes = append(volumes, &dockerVolume.Volume{
+				Name:       volume.Name,
+				Mountpoint: volume.GetDataDir(),
+				CreatedAt:  volume.CreatedAt,
+			})
+			volume.mutex.Unlock()
+		}
 	}
 
 	return &dockerVolume.ListResponse{Volumes: volumes}, nil
@@ -0,0 +1,118 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestRemoveVolumeOfAnotherNode(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	if err := volume.unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// h2 lists the volume, but never attached it
+	setTestHost(t, "h2")
+	driver := newTestDriver()
+	if err := driver.Remove(&dockerVolume.RemoveRequest{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(volume.Mountpoint) {
+		t.Fatal("Volume of another node was not removed")
+	}
+}
+
+// Makes the calls Docker makes concurrently with the maintenance, run it with -race
+func TestConcurrentPluginCalls(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	driver := newTestDriver()
+	driver.addVolume(createTestVolume(t, "data", volumeMetadata{}))
+
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func(id string) {
+			defer group.Done()
+
+			for j := 0; j < 10; j++ {
+				if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: id}); err != nil {
+					t.Error(err)
+				}
+				if _, err := driver.Path(&dockerVolume.PathRequest{Name: "data"}); err != nil {
+					t.Error(err)
+				}
+				if _, err := driver.Get(&dockerVolume.GetRequest{Name: "data"}); err != nil {
+					t.Error(err)
+				}
+				if _, err := driver.List(); err != nil {
+					t.Error(err)
+				}
+				if err := driver.Unmount(&dockerVolume.UnmountRequest{Name: "data", ID: id}); err != nil {
+					t.Error(err)
+				}
+				driver.Cleanup()
+			}
+		}(fmt.Sprintf("c%d", i))
+	}
+	group.Wait()
+}
+
+func TestHostExclusiveMountsJoinAfterWaiting(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{HostExclusive: true, MountTimeout: 30, MountRetry: 1})
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	held, err := mountTestVolume(other, "c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	driver := newTestDriver()
+	driver.addVolume(volume)
+
+	errs := make(chan error, 2)
+	for _, id := range []string{"c1", "c2"} {
+		go func(id string) {
+			_, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: id})
+			errs <- err
+		}(id)
+	}
+
+	// Both mounts of h1 wait for h2 to give up the volume
+	for deadline := time.Now().Add(10 * time.Second); len(other.getQueue()) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("Mounts did not queue for the volume")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = held.remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	mount, err := other.loadMountFile(other.getExclusiveMountFile())
+	if err != nil || mount == nil {
+		t.Fatalf("Volume is not mounted: %v", err)
+	}
+	if mount.Hostname != "h1" || !mount.hasMountID("c1") || !mount.hasMountID("c2") {
+		t.Errorf("Mount %v of host %s does not hold both mounts", mount.MountIDs, mount.Hostname)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// Changes of volumes made by other nodes
+const (
+	volumeEventRemoved   = "removed"
+	volumeEventRecreated = "recreated"
+	volumeEventChanged   = "changed"
+)
+
+// Reports a change of a volume as a structured log entry
+func emitVolumeEvent(event string, volume string, message string) {
+	log.WithFields(log.Fields{
+		"event":  event,
+		"volume": volume,
+	}).Info(message)
+}
@@ -0,0 +1,409 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Holds kernel advisory locks (flock) on the lock and mount files for as long as they are in use.
+// On filesystems with cluster coherent locking (gfs2, cephfs, beegfs with global file locks)
+// the kernel releases the locks when a node dies, so no timeouts are involved.
+// A lock or mount file that nobody holds a lock on belongs to a host that is gone.
+type flockBackend struct {
+	mutex *sync.Mutex
+	files map[string]*os.File
+}
+
+func newFlockBackend() *flockBackend {
+	return &flockBackend{
+		mutex: &sync.Mutex{},
+		files: make(map[string]*os.File),
+	}
+}
+
+func (backend *flockBackend) lock(volume *sharedVolume) error {
+
+	// The timestamp is kept up to date for inspection
+	if err := volume.writeLockFile(); err != nil {
+		return err
+	}
+
+	lockFilename := volume.GetLockFile()
+
+	// The files are only looked up under the mutex, the calls on the root are made without it
+	if file, ok := backend.get(lockFilename); ok {
+		same, err := fsSameFile(file, lockFilename)
+		if err != nil || same {
+			return err
+		}
+
+		// The lock file was replaced, the lock we hold protects nothing
+		log.Warnf("Lock file %s was replaced, locking it again", lockFilename)
+		backend.close(lockFilename)
+	}
+
+	file, err := fsFlockFile(lockFilename, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+
+	backend.put(lockFilename, file)
+
+	return nil
+}
+
+func (backend *flockBackend) unlock(volume *sharedVolume) error {
+	lockFilename := volume.GetLockFile()
+
+	// Remove before releasing, so no-one can lock the file in between
+	err := volume.removeLockFile()
+	backend.close(lockFilename)
+
+	return err
+}
+
+func (backend *flockBackend) isLocked(volume *sharedVolume) (bool, error) {
+	locksDir := volume.GetLocksDir()
+
+	files, err := fsReadDir(locksDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".lock" {
+			if backend.isHeld(filepath.Join(locksDir, file.Name())) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (backend *flockBackend) acquire(mount *volumeMount) error {
+
+	content, err := json.MarshalIndent(mount, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if file, ok := backend.get(mount.LockFilePath); ok {
+		if same, err := fsSameFile(file, mount.LockFilePath); err != nil || same {
+			// Already held by this process
+			return &os.PathError{Op: "flock", Path: mount.LockFilePath, Err: os.ErrExist}
+		}
+
+		// Our mount expired and another host removed the file
+		backend.close(mount.LockFilePath)
+	}
+
+	// Another mount of this process trying the same file fails on the exclusive flock
+	file, err := fsFlockFile(mount.LockFilePath, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+
+	// The file may still contain the record of a previous holder
+	if err = fsWriteHeldFile(file, content); err != nil {
+		fsRemove(mount.LockFilePath)
+		file.Close()
+		return err
+	}
+
+	backend.put(mount.LockFilePath, file)
+
+	return nil
+}
+
+func (backend *flockBackend) update(mount *volumeMount) error {
+
+	content, err := json.MarshalIndent(mount, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Renaming a new file over it would leave the lock behind on the old file,
+	// so the content is replaced in place
+	file, ok := backend.get(mount.LockFilePath)
+	if !ok {
+		return fmt.Errorf("Mount file %s is not held by this host", mount.LockFilePath)
+	}
+
+	// Another host removes the mount file once its heartbeat expired
+	if same, err := fsSameFile(file, mount.LockFilePath); err != nil {
+		return err
+	} else if !same {
+		return fmt.Errorf("Mount file %s was removed or taken over by another host", mount.LockFilePath)
+	}
+
+	return fsWriteHeldFile(file, content)
+}
+
+func (backend *flockBackend) release(mount *volumeMount) error {
+	var err error
+
+	// A file that replaced ours after our mount expired belongs to another host
+	remove := true
+	if file, ok := backend.get(mount.LockFilePath); ok {
+		if same, sameErr := fsSameFile(file, mount.LockFilePath); sameErr == nil && !same {
+			remove = false
+		}
+	}
+
+	// Remove before releasing, so waiters notice the file is gone
+	if remove {
+		err = mount.remove()
+	}
+	backend.close(mount.LockFilePath)
+
+	return err
+}
+
+func (backend *flockBackend) reclaim(volume *sharedVolume, mount *volumeMount) (bool, error) {
+	// The lock of a holder that is gone is released by the kernel,
+	// so acquire succeeds on its own.
+	return false, nil
+}
+
+func (backend *flockBackend) isAlive(volume *sharedVolume, host string) bool {
+	return backend.isHeld(volume.GetLockFileFor(host))
+}
+
+func (backend *flockBackend) cleanup(volume *sharedVolume) {
+	locksDir := volume.GetLocksDir()
+
+	files, err := fsReadDir(locksDir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		fileName := file.Name()
+		extension := filepath.Ext(fileName)
+
+		if file.IsDir() || (extension != ".lock" && extension != ".mount") {
+			continue
+		}
+
+		fullPath := filepath.Join(locksDir, fileName)
+		if removed, err := backend.removeUnheld(fullPath); err == nil && removed {
+			log.Infof("Removed %s of volume %s, no-one held it", fileName, volume.Name)
+		} else if err == nil && extension == ".mount" {
+			backend.expireMount(volume, fullPath)
+		}
+	}
+}
+
+// Removes the mount file of another host if its heartbeat expired. The host is alive,
+// but no container used the mount for too long. It still holds its lock on the removed file,
+// and notices the mount was taken over the next time it refreshes it.
+func (backend *flockBackend) expireMount(volume *sharedVolume, filename string) {
+	mount, err := volume.loadMountFile(filename)
+	if err != nil || mount == nil || mount.Hostname == *hostname || !volume.isMountExpired(mount) {
+		return
+	}
+
+	// Don't trust the heartbeat if the clocks disagree
+	lock, err := volume.getLock(mount.Hostname)
+	if err != nil || lock == nil {
+		return
+	}
+	if err = volume.checkClockSkew(lock); err != nil {
+		log.Warn(err)
+		return
+	}
+
+	log.Infof("Removing expired mount %s of volume %s on host %s", mount.MountID, volume.Name, mount.Hostname)
+	mount.remove()
+}
+
+// Returns true if anyone holds a lock on the file
+func (backend *flockBackend) isHeld(filename string) bool {
+	if _, ok := backend.get(filename); ok {
+		// Never probe our own files. On filesystems emulating flock with fcntl
+		// closing the probe would drop our own lock.
+		return true
+	}
+
+	held, err := filesystem.call("flock", filename, func() (interface{}, error) {
+		return probeFlock(filename)
+	})
+	if err != nil {
+		// If it cannot be checked it is better to assume it is in use
+		return !os.IsNotExist(err)
+	}
+
+	return held.(bool)
+}
+
+// Removes the file if no-one holds a lock on it. The file is removed while we hold
+// an exclusive lock on it, so no other host can lock it in between and lose it.
+// Returns true if it was removed.
+func (backend *flockBackend) removeUnheld(filename string) (bool, error) {
+	if _, ok := backend.get(filename); ok {
+		return false, nil
+	}
+
+	removed, err := filesystem.call("flock", filename, func() (interface{}, error) {
+		file, err := flockFile(filename, syscall.LOCK_EX)
+		if os.IsExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		defer file.Close()
+
+		return true, os.Remove(filename)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return removed.(bool), nil
+}
+
+// Returns true if someone holds a lock on the file, by trying to lock it
+func probeFlock(filename string) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return true, nil
+	}
+
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	return false, nil
+}
+
+func (backend *flockBackend) get(filename string) (*os.File, bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	file, ok := backend.files[filename]
+	return file, ok
+}
+
+// Remembers a file we hold a lock on. If another call locked the file in the meantime,
+// its file is kept and ours is closed.
+func (backend *flockBackend) put(filename string, file *os.File) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if _, ok := backend.files[filename]; ok {
+		file.Close()
+		return
+	}
+
+	backend.files[filename] = file
+}
+
+func (backend *flockBackend) close(filename string) {
+	backend.mutex.Lock()
+	file, ok := backend.files[filename]
+	delete(backend.files, filename)
+	backend.mutex.Unlock()
+
+	if ok {
+		file.Close()
+	}
+}
+
+// Replaces the content of a file we hold a lock on
+func writeHeldFile(file *os.File, content []byte) error {
+	written := 0
+
+	err := file.Truncate(0)
+	if err == nil {
+		written, err = file.WriteAt(content, 0)
+	}
+
+	if err == nil && written != len(content) {
+		err = io.ErrShortWrite
+	}
+
+	return err
+}
+
+func fsWriteHeldFile(file *os.File, content []byte) error {
+	_, err := filesystem.call("write", file.Name(), func() (interface{}, error) {
+		return nil, writeHeldFile(file, content)
+	})
+	return err
+}
+
+func fsFlockFile(filename string, how int) (*os.File, error) {
+	file, err := filesystem.call("flock", filename, func() (interface{}, error) {
+		return flockFile(filename, how)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file.(*os.File), nil
+}
+
+func fsSameFile(file *os.File, filename string) (bool, error) {
+	same, err := filesystem.call("stat", filename, func() (interface{}, error) {
+		return sameFile(file, filename), nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return same.(bool), nil
+}
+
+// Opens or creates the file and places a non-blocking advisory lock on it.
+// Fails with an os.IsExist error if someone else holds a conflicting lock.
+func flockFile(filename string, how int) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+			file.Close()
+
+			if err == syscall.EWOULDBLOCK {
+				return nil, &os.PathError{Op: "flock", Path: filename, Err: os.ErrExist}
+			}
+			return nil, err
+		}
+
+		// The previous holder removes the file before releasing it,
+		// make sure the lock is on the file that is still there.
+		if sameFile(file, filename) {
+			return file, nil
+		}
+
+		file.Close()
+	}
+}
+
+// Returns true if the open file is still reachable under its name
+func sameFile(file *os.File, filename string) bool {
+	openInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	pathInfo, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(openInfo, pathInfo)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Serializes mounting and unmounting the members of a group on this host
+var (
+	groupMutexes     = make(map[string]*sync.Mutex)
+	groupMutexesLock sync.Mutex
+)
+
+func groupMutex(name string) *sync.Mutex {
+	groupMutexesLock.Lock()
+	defer groupMutexesLock.Unlock()
+
+	mutex, ok := groupMutexes[name]
+	if !ok {
+		mutex = &sync.Mutex{}
+		groupMutexes[name] = mutex
+	}
+
+	return mutex
+}
+
+// Every member of a group has an empty file named after it in the group directory
+func getGroupDir(name string) string {
+	return filepath.Join(*root, "_groups", name)
+}
+
+// The mount ID recorded when a member is only held for its group
+func (volume *sharedVolume) getGroupMountID() string {
+	return fmt.Sprintf("group-%s@%s", volume.Group, *hostname)
+}
+
+// Returns the names of the members of a group, in lock order
+func getGroupMembers(name string) ([]string, error) {
+	files, err := fsReadDir(getGroupDir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(files))
+	for _, file := range files {
+		members = append(members, file.Name())
+	}
+
+	return members, nil
+}
+
+// Registers the volume as a member of its group
+func (volume *sharedVolume) joinGroup() error {
+	if volume.Group == "" {
+		return nil
+	}
+
+	groupDir := getGroupDir(volume.Group)
+	if err := fsMkdirAll(groupDir, 0750); err != nil {
+		return err
+	}
+
+	return fsWriteFile(filepath.Join(groupDir, volume.Name), nil, 0600)
+}
+
+// Removes the volume from its group, and the group once it is empty
+func (volume *sharedVolume) leaveGroup() {
+	if volume.Group == "" {
+		return
+	}
+
+	groupDir := getGroupDir(volume.Group)
+	fsRemove(filepath.Join(groupDir, volume.Name))
+	fsRemove(groupDir)
+}
+
+// Mounts a member of a group. The host holds every member of the group,
+// taking them in name order, so hosts mounting different members cannot deadlock.
+// If any member cannot be taken, the ones taken here are given up again.
+// Members are locked one at a time, the caller must not hold the mutex of any of them.
+// The caller reads the group of the volume while holding its mutex.
+func (driver sharedVolumeDriver) mountGroup(volume *sharedVolume, group string, id string) (*volumeMount, error) {
+	mutex := groupMutex(group)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	volume.mutex.Lock()
+	err := volume.joinGroup()
+	volume.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := getGroupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+
+	type heldMember struct {
+		volume *sharedVolume
+		mount  *volumeMount
+	}
+	acquired := []heldMember{}
+
+	// Gives up the members taken here, in reverse order
+	rollback := func() {
+		for i := len(acquired) - 1; i >= 0; i-- {
+			acquired[i].volume.mutex.Lock()
+			if releaseErr := acquired[i].volume.releaseMount(acquired[i].mount); releaseErr != nil {
+				log.Warnf("Failed to release group member %s: %s", acquired[i].volume.Name, releaseErr)
+			}
+			acquired[i].volume.mutex.Unlock()
+		}
+	}
+
+	for _, name := range members {
+		member, err := driver.attachVolume(name)
+		if err == nil {
+			var mount *volumeMount
+			var isNew bool
+
+			// The other members must be mountable on this host as well
+			member.mutex.Lock()
+			if member != volume {
+				err = member.checkMount()
+			}
+			if err == nil {
+				mount, isNew, err = member.holdHostExclusive("")
+			}
+			member.mutex.Unlock()
+
+			if err == nil && isNew {
+				acquired = append(acquired, heldMember{member, mount})
+			}
+		}
+
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("Failed to acquire member %s of group %s: %s", name, group, err)
+		}
+	}
+
+	volume.mutex.Lock()
+	mount, _, err := volume.holdHostExclusive(id)
+	volume.mutex.Unlock()
+
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("Failed to mount member %s of group %s: %s", volume.Name, group, err)
+	}
+
+	return mount, nil
+}
+
+// Unmounts a member of a group.
+// The group is released once none of its members are mounted on this host.
+// Members are locked one at a time, the caller must not hold the mutex of any of them.
+// The caller reads the group of the volume while holding its mutex.
+func (driver sharedVolumeDriver) unmountGroup(volume *sharedVolume, group string, id string) error {
+	mutex := groupMutex(group)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	volume.mutex.Lock()
+	mount, err := volume.findMount(id)
+	if err == nil && mount != nil && mount.Hostname == *hostname {
+		err = volume.removeMountID(mount, id)
+	} else if err == nil {
+		log.Warnf("Trying to unmount a volume that is not mounted")
+		mount = nil
+	}
+	volume.mutex.Unlock()
+
+	if err != nil || mount == nil {
+		return err
+	}
+
+	members, err := getGroupMembers(group)
+	if err != nil {
+		return err
+	}
+
+	held := []*sharedVolume{}
+	for _, name := range members {
+		member, err := driver.attachVolume(name)
+		if err != nil {
+			return err
+		}
+
+		member.mutex.Lock()
+		mount, err = member.loadMountFile(member.getExclusiveMountFile())
+		member.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if mount == nil || mount.Hostname != *hostname {
+			continue
+		}
+
+		if len(mount.MountIDs) > 0 {
+			// The group is still in use
+			return nil
+		}
+
+		held = append(held, member)
+	}
+
+	for i := len(held) - 1; i >= 0; i-- {
+		held[i].mutex.Lock()
+		if mount, err = held[i].loadMountFile(held[i].getExclusiveMountFile()); err == nil && mount != nil {
+			err = held[i].releaseMount(mount)
+		}
+		held[i].mutex.Unlock()
+
+		if err != nil {
+			log.Warnf("Failed to release group member %s: %s", held[i].Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+// Creates a volume on the current host as a member of the group.
+// Members are host exclusive, like the group option makes them.
+func createTestMember(t *testing.T, name string, group string, metadata volumeMetadata) *sharedVolume {
+	metadata.Group = group
+	metadata.HostExclusive = true
+	volume := createTestVolume(t, name, metadata)
+	if err := volume.joinGroup(); err != nil {
+		t.Fatal(err)
+	}
+	return volume
+}
+
+func TestRemoveLeavesGroupOnlyWhenRemoved(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestMember(t, "a", "db", volumeMetadata{})
+	createTestMember(t, "b", "db", volumeMetadata{})
+	membership := filepath.Join(getGroupDir("db"), "a")
+
+	// h2 still uses the volume
+	setTestHost(t, "h2")
+	attachTestVolume(t, "a")
+
+	setTestHost(t, "h1")
+	driver := newTestDriver()
+	driver.addVolume(volume)
+	if err := driver.Remove(&dockerVolume.RemoveRequest{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(volume.Mountpoint) || !exists(membership) {
+		t.Fatal("Volume other hosts still use was removed from its group")
+	}
+
+	setTestHost(t, "h2")
+	if err := newTestDriver().Remove(&dockerVolume.RemoveRequest{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(volume.Mountpoint) || exists(membership) {
+		t.Fatal("Removed volume is still a member of its group")
+	}
+
+	members, err := getGroupMembers("db")
+	if err != nil || len(members) != 1 || members[0] != "b" {
+		t.Errorf("Group has members %v: %v", members, err)
+	}
+}
+
+func TestGroupMountChecksEveryMember(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestMember(t, "a", "db", volumeMetadata{})
+	createTestMember(t, "b", "db", volumeMetadata{DeniedHosts: []string{"h1"}})
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+
+	if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "a", ID: "c1"}); err == nil {
+		t.Fatal("Group was mounted on a host one of its members denies")
+	}
+	if exists(volume.getExclusiveMountFile()) {
+		t.Error("Member was left mounted")
+	}
+}
+
+func TestGroupMountRollsBackWhenTheLastStepFails(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestMember(t, "a", "db", volumeMetadata{})
+	member := createTestMember(t, "b", "db", volumeMetadata{})
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+	driver.addVolume(member)
+
+	// Adding the mount id to the held mount file of a fails
+	if err := os.Mkdir(volume.getExclusiveMountFile()+"."+*hostname+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.mountGroup(volume, "db", "c1"); err == nil {
+		t.Fatal("Group was mounted although the mount id was not recorded")
+	}
+	if exists(volume.getExclusiveMountFile()) || exists(member.getExclusiveMountFile()) {
+		t.Error("Members were left held by the host")
+	}
+}
+
+func TestGroupStaysHeldAfterAMemberIsUnmounted(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	volume := createTestMember(t, "a", "db", volumeMetadata{})
+	member := createTestMember(t, "b", "db", volumeMetadata{})
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+	driver.addVolume(member)
+
+	fake.addContainer("c1", "running", "a")
+	fake.addContainer("c2", "running", "b")
+	for name, id := range map[string]string{"a": "c1", "b": "c2"} {
+		if _, err := driver.Mount(&dockerVolume.MountRequest{Name: name, ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The container of a stopped, the one of b keeps the group in use
+	fake.setState("c1", "exited")
+	if err := driver.Unmount(&dockerVolume.UnmountRequest{Name: "a", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.Reconcile()
+
+	if !exists(volume.getExclusiveMountFile()) || !exists(member.getExclusiveMountFile()) {
+		t.Error("Member of a group in use was released")
+	}
+}
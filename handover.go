@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Built-in handover hook stopping the local containers using the volume
+const handoverHookDockerStop = "docker-stop"
+
+// How long a container gets to stop when a handover is requested
+const handoverStopTimeout = 10 * time.Second
+
+// A request of a waiting host to hand over an exclusive mount
+type handoverRequest struct {
+	Hostname  string
+	MountID   string
+	Requested string
+
+	filename string
+}
+
+func (volume *sharedVolume) GetHandoverFileFor(name string) string {
+	return filepath.Join(volume.GetLocksDir(), fmt.Sprintf("%s.handover", name))
+}
+
+// Asks the holders of the volume to hand over their mount.
+// The request is removed by the requester once it stops waiting.
+func (volume *sharedVolume) requestHandover(mount *volumeMount) (*handoverRequest, error) {
+	request := &handoverRequest{
+		Hostname:  mount.Hostname,
+		MountID:   mount.MountID,
+		Requested: time.Now().Format(time.RFC3339),
+		filename:  volume.GetHandoverFileFor(mount.Hostname),
+	}
+
+	content, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fsWriteFile(request.filename, content, 0600); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func (request *handoverRequest) remove() error {
+	return fsRemove(request.filename)
+}
+
+// Returns the handover requests of other hosts.
+// Requests left behind by hosts that are gone are removed.
+func (volume *sharedVolume) getHandoverRequests() []*handoverRequest {
+	requests := []*handoverRequest{}
+
+	locksDir := volume.GetLocksDir()
+
+	files, err := fsReadDir(locksDir)
+	if err != nil {
+		return requests
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".handover" {
+			continue
+		}
+
+		filename := filepath.Join(locksDir, file.Name())
+		content, err := fsReadFile(filename)
+		if err != nil {
+			continue
+		}
+
+		request := &handoverRequest{filename: filename}
+		if err = json.Unmarshal(content, request); err != nil || request.Hostname == *hostname {
+			continue
+		}
+
+		if !locking.isAlive(volume, request.Hostname) {
+			log.Debugf("Removing handover request of host %s for volume %s, the host is gone", request.Hostname, volume.Name)
+			request.remove()
+			continue
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+// Runs the handover hook for new requests on volumes this host has mounted.
+// Every request is handled once, the hooks run in the background.
+func (driver sharedVolumeDriver) HandleHandovers() {
+	if handoverHook == "" {
+		return
+	}
+
+	// The requests are only tracked by the maintenance routine
+	pending := make(map[string]string)
+
+	for _, volume := range driver.snapshot() {
+		volume.mutex.Lock()
+		var requests []*handoverRequest
+		if volume.isMountedBy(*hostname) {
+			requests = volume.getHandoverRequests()
+		}
+		// The group is only handed over once none of its members are in use
+		names, err := volume.groupVolumeNames()
+		if err != nil {
+			log.Warnf("Failed to read the group of volume %s: %s", volume.Name, err)
+			names = []string{volume.Name}
+		}
+		// The hook has to finish well before the lock could time out
+		timeout := volume.lockTimeout() / 3
+		volume.mutex.Unlock()
+
+		for _, request := range requests {
+			pending[request.filename] = request.Requested
+
+			if driver.handovers[request.filename] == request.Requested {
+				continue
+			}
+
+			log.Infof("Host %s requested a handover of volume %s", request.Hostname, volume.Name)
+			go runHandoverHook(handoverHook, volume.Name, names, request.Hostname, timeout)
+		}
+	}
+
+	// Forget the requests that are gone
+	for filename := range driver.handovers {
+		delete(driver.handovers, filename)
+	}
+	for filename, requested := range pending {
+		driver.handovers[filename] = requested
+	}
+}
+
+// Returns true if the host has any mount of the volume
+func (volume *sharedVolume) isMountedBy(host string) bool {
+	for _, mount := range volume.getMounts() {
+		if mount.Hostname == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Runs the hook for a handover of the volume. The docker-stop hook stops the containers
+// using any of the volumes named. Both are given up once the timeout passed.
+func runHandoverHook(hook string, volumeName string, volumeNames []string, requester string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+
+	if hook == handoverHookDockerStop {
+		err = stopContainersUsing(ctx, volumeNames)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("Gave up stopping containers after %s", timeout)
+		}
+	} else {
+		var output []byte
+		output, err = exec.CommandContext(ctx, hook, volumeName, requester).CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("Killed after %s", timeout)
+		}
+		if err != nil && len(output) > 0 {
+			err = fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Handover hook for volume %s failed: %s", volumeName, err)
+	}
+}
+
+// Stops the running containers on this host that use any of the volumes.
+// The containers are stopped at the same time, they get at most half of the
+// time left to stop before they are killed.
+func stopContainersUsing(ctx context.Context, volumeNames []string) error {
+	containers, err := engine.runningContainers(ctx, volumeNames)
+	if err != nil {
+		return err
+	}
+
+	stopTimeout := handoverStopTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline) / 2; left < stopTimeout {
+			stopTimeout = left
+		}
+	}
+
+	errs := make(chan error, len(containers))
+	for _, container := range containers {
+		log.Infof("Stopping container %s to hand over volumes %s", container.ID, strings.Join(volumeNames, ", "))
+
+		go func(id string) {
+			errs <- engine.stopContainer(ctx, id, stopTimeout)
+		}(container.ID)
+	}
+
+	for range containers {
+		if stopErr := <-errs; stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,119 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a handover hook script with the body
+func writeTestHook(t *testing.T, body string) string {
+	path := filepath.Join(*root, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHandoverHookRunsOnRequest(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	output := filepath.Join(*root, "hook.out")
+	defer func(hook string) { handoverHook = hook }(handoverHook)
+	handoverHook = writeTestHook(t, `echo "$1 $2" > `+output)
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	if _, err := other.requestHandover(other.newMount("c2")); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	driver := newTestDriver()
+	driver.addVolume(volume)
+	driver.HandleHandovers()
+
+	for deadline := time.Now().Add(5 * time.Second); !exists(output); {
+		if time.Now().After(deadline) {
+			t.Fatal("Handover hook did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Let the hook finish writing
+	time.Sleep(50 * time.Millisecond)
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arguments := strings.TrimSpace(string(content)); arguments != "data h2" {
+		t.Errorf("Hook was called with %q", arguments)
+	}
+}
+
+func TestHandoverHookIsKilledAfterTimeout(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	hook := writeTestHook(t, "exec sleep 10")
+
+	started := time.Now()
+	runHandoverHook(hook, "data", []string{"data"}, "h2", 100*time.Millisecond)
+
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("Hook ran for %s", took)
+	}
+}
+
+func TestHandoverDockerStopStopsTheWholeGroup(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	volume := createTestMember(t, "a", "db", volumeMetadata{})
+	createTestMember(t, "b", "db", volumeMetadata{})
+	createTestVolume(t, "other", volumeMetadata{})
+
+	fake.addContainer("c1", "running", "a")
+	fake.addContainer("c2", "running", "b")
+	fake.addContainer("c3", "running", "other")
+
+	names, err := volume.groupVolumeNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHandoverHook(handoverHookDockerStop, "a", names, "h2", time.Second)
+
+	for _, id := range []string{"c1", "c2"} {
+		if state := fake.state(id); state != "exited" {
+			t.Errorf("Container %s of the group is %s", id, state)
+		}
+	}
+	if state := fake.state("c3"); state != "running" {
+		t.Errorf("Container of another volume is %s", state)
+	}
+}
+
+func TestHandoverDockerStopGivesUpAfterTimeout(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	fake.stopDelay = 10 * time.Second
+	fake.addContainer("c1", "running", "data")
+	fake.addContainer("c2", "running", "data")
+
+	started := time.Now()
+	runHandoverHook(handoverHookDockerStop, "data", []string{"data"}, "h2", 100*time.Millisecond)
+
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("Stopping the containers took %s", took)
+	}
+}
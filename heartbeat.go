@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Container states in which Docker keeps the volumes of a container mounted
+var attachedContainerStates = map[string]bool{
+	"created":    true,
+	"running":    true,
+	"paused":     true,
+	"restarting": true,
+}
+
+// Returns how long ago the holder of the mount last confirmed it is in use
+func (mount *volumeMount) leaseAge() time.Duration {
+	if leaseMode == leaseModeObserve {
+		return observer.observe(mount.LockFilePath, mount.Heartbeat, time.Time{})
+	}
+
+	heartbeat, err := time.Parse(time.RFC3339, mount.Heartbeat)
+	if err != nil {
+		return 0
+	}
+
+	return time.Now().UTC().Sub(heartbeat)
+}
+
+// Returns true if the heartbeat of the mount was not refreshed within the lock timeout.
+// Mounts written without a heartbeat only expire with the lock of their host.
+func (volume *sharedVolume) isMountExpired(mount *volumeMount) bool {
+	if mount.Heartbeat == "" {
+		return false
+	}
+
+	return mount.leaseAge() >= volume.lockTimeout()
+}
+
+// Returns the names of the volume and the other members of its group.
+// A host holds every member of a group while any of them is in use.
+func (volume *sharedVolume) groupVolumeNames() ([]string, error) {
+	if volume.Group == "" {
+		return []string{volume.Name}, nil
+	}
+
+	return getGroupMembers(volume.Group)
+}
+
+// Returns the containers on this host that have the volume, or any member of its group, attached
+func (driver sharedVolumeDriver) volumeContainers(volume *sharedVolume) (map[string]bool, error) {
+	names, err := volume.groupVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+
+	attached := make(map[string]bool)
+	for _, name := range names {
+		containers, err := engine.attachedContainers(name)
+		if err != nil {
+			return nil, err
+		}
+		for id := range containers {
+			attached[id] = true
+		}
+	}
+
+	return attached, nil
+}
+
+// Returns true if the container the mount was made for is still attached.
+// A mount file shared by several mounts, or one whose container is unknown,
+// is in use while any container has the volume attached.
+func (mount *volumeMount) isAttached(attached map[string]bool) bool {
+	if mount.ContainerID == "" || len(mount.MountIDs) > 1 {
+		return len(attached) > 0
+	}
+
+	return attached[mount.ContainerID]
+}
+
+// Refreshes the heartbeats of this host's mounts of the volume while Docker has their
+// container attached. Mounts that are no longer attached are left to expire,
+// and released once they did.
+func (driver sharedVolumeDriver) refreshMounts(volume *sharedVolume) {
+	var mounts []*volumeMount
+	for _, mount := range volume.getMounts() {
+		if mount.Hostname == *hostname && !mount.owner().isPreviousIncarnation() {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	if len(mounts) == 0 {
+		return
+	}
+
+	// Without access to Docker every mount counts as attached
+	var attached map[string]bool
+	if engine != nil {
+		var err error
+		if attached, err = driver.volumeContainers(volume); err != nil {
+			log.Debugf("Cannot tell if volume %s is attached, refreshing its mounts: %s", volume.Name, err)
+			attached = nil
+		}
+	}
+
+	for _, mount := range mounts {
+		if attached == nil || mount.isAttached(attached) {
+			mount.Heartbeat = time.Now().UTC().Format(time.RFC3339)
+			if err := locking.update(mount); err != nil {
+				log.Warnf("Failed to refresh mount %s of volume %s: %s", mount.MountID, volume.Name, err)
+			}
+		} else if volume.isMountExpired(mount) {
+			log.Infof("Releasing mount %s of volume %s, no container uses it anymore", mount.MountID, volume.Name)
+			if err := volume.releaseMount(mount); err != nil {
+				log.Warnf("Failed to release mount %s of volume %s: %s", mount.MountID, volume.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatFollowsTheContainerOfTheMount(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+
+	mounts := make(map[string]*volumeMount)
+	for _, id := range []string{"c1", "c2"} {
+		container := fake.addContainer(id, "running", "data")
+
+		mount, err := mountTestVolume(volume, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volume.recordContainer(mount, &container)
+		mounts[id] = mount
+	}
+
+	// c2 crashed while c1 keeps using the volume
+	fake.setState("c2", "exited")
+	for _, mount := range mounts {
+		mount.Heartbeat = time.Now().Add(-2 * lockTimeout).UTC().Format(time.RFC3339)
+		if err := locking.update(mount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newTestDriver().refreshMounts(volume)
+
+	if !exists(mounts["c1"].LockFilePath) {
+		t.Fatal("Mount of a running container was released")
+	}
+	if exists(mounts["c2"].LockFilePath) {
+		t.Fatal("Mount of a crashed container was kept")
+	}
+
+	refreshed, err := volume.loadMountFile(mounts["c1"].LockFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.isMountExpired(refreshed) {
+		t.Error("Heartbeat of a running container was not refreshed")
+	}
+}
+
+func TestCleanupRemovesExpiredMountsOfLiveHosts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		wait := false
+		volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+		mount, err := mountTestVolume(volume, "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// h1 keeps running, but no container used the mount for too long
+		mount.Heartbeat = time.Now().Add(-2 * lockTimeout).UTC().Format(time.RFC3339)
+		if err = locking.update(mount); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestHost(t, "h2")
+		other := attachTestVolume(t, "data")
+		locking.cleanup(other)
+
+		taken, err := mountTestVolume(other, "c2")
+		if err != nil {
+			t.Fatalf("Expired mount was not removed: %s", err)
+		}
+
+		setTestHost(t, "h1")
+		if err = locking.update(mount); err == nil {
+			t.Error("Expired mount was refreshed after another host took it over")
+		}
+
+		// The flock backend can tell the file it holds from the one that replaced it
+		if _, ok := locking.(*flockBackend); ok {
+			if err = volume.releaseMount(mount); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(taken.LockFilePath) {
+				t.Error("Releasing the expired mount removed the mount of h2")
+			}
+		}
+	})
+}
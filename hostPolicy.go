@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Parses a comma separated list of host name glob patterns.
+// Returns an error if any pattern is invalid, or the list has none.
+func parseHostPatterns(value string) ([]string, error) {
+	patterns := []string{}
+
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid host pattern %s: %s", pattern, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("No host patterns in %q", value)
+	}
+
+	return patterns, nil
+}
+
+// Returns the first pattern matching the host, or an empty string
+func matchHostPattern(patterns []string, host string) string {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return pattern
+		}
+	}
+
+	return ""
+}
+
+// Returns an error naming the policy if the host is not allowed to mount the volume.
+// The deny list takes precedence over the allow list.
+func (volume *sharedVolume) checkHostPolicy(host string) error {
+	if pattern := matchHostPattern(volume.DeniedHosts, host); pattern != "" {
+		return fmt.Errorf("Host %s is not allowed to mount volume %s: it matches '%s' in denied-hosts", host, volume.Name, pattern)
+	}
+
+	if len(volume.AllowedHosts) > 0 && matchHostPattern(volume.AllowedHosts, host) == "" {
+		return fmt.Errorf("Host %s is not allowed to mount volume %s: it matches nothing in allowed-hosts (%s)", host, volume.Name, strings.Join(volume.AllowedHosts, ","))
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestHostPolicyOfTheVolumeIsChecked(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	options := map[string]string{"allowed-hosts": "h*", "denied-hosts": "h2"}
+	if err := newTestDriver().Create(&dockerVolume.CreateRequest{Name: "data", Options: options}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"h1": "", "h2": "denied-hosts", "db1": "allowed-hosts"}
+	for host, policy := range expected {
+		setTestHost(t, host)
+		driver := newTestDriver()
+
+		_, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: "c-" + host})
+		if policy == "" && err != nil {
+			t.Errorf("Host %s failed to mount the volume: %s", host, err)
+		} else if policy != "" && (err == nil || !strings.Contains(err.Error(), policy)) {
+			t.Errorf("Host %s mounted the volume against %s: %v", host, policy, err)
+		}
+	}
+}
+
+func TestInvalidHostPatternsAreRejected(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	invalid := []map[string]string{
+		{"allowed-hosts": "["},
+		{"allowed-hosts": " , "},
+		{"allowed-hosts": "h*, ["},
+		{"denied-hosts": "h2, ["},
+	}
+
+	for _, options := range invalid {
+		if err := newTestDriver().Create(&dockerVolume.CreateRequest{Name: "data", Options: options}); err == nil {
+			t.Errorf("Volume was created with %v", options)
+		}
+	}
+
+	if exists(filepath.Join(*root, "data")) {
+		t.Error("Volume with invalid host patterns was written to the root")
+	}
+}
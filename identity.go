@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// Identifies a single run of the driver.
+// It is written into the lock files, so other nodes can tell
+// a restarted owner apart from one that kept running.
+type nodeIdentity struct {
+	Hostname  string
+	BootID    string
+	PID       int
+	Version   string
+	StartedAt string
+	Nonce     string
+}
+
+// The identity of this driver instance
+var self = &nodeIdentity{}
+
+// The node keeps the nonce it writes into lock files on its local disk, so the next run
+// can tell the lock files it wrote apart from those of another node with the same hostname
+var (
+	previousNonce = ""
+	savedNonce    = ""
+	nonceMutex    = &sync.Mutex{}
+)
+
+func getNonceFile() string {
+	return filepath.Join(stateDir, "nonce")
+}
+
+// Returns the nonce the previous run of the driver on this node wrote into its lock files
+func loadPreviousNonce() string {
+	if stateDir == "" {
+		return ""
+	}
+
+	content, err := ioutil.ReadFile(getNonceFile())
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to read the nonce of the previous run: %s", err)
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// Records the nonce of this run, once it is written into a lock file
+func saveNonce() {
+	if stateDir == "" {
+		return
+	}
+
+	nonceMutex.Lock()
+	defer nonceMutex.Unlock()
+
+	if savedNonce == self.Nonce {
+		return
+	}
+
+	err := os.MkdirAll(stateDir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(getNonceFile(), []byte(self.Nonce+"\n"), 0600)
+	}
+	if err != nil {
+		log.Warnf("Failed to record the nonce of this run: %s", err)
+		return
+	}
+
+	savedNonce = self.Nonce
+}
+
+func newNodeIdentity(hostname string) *nodeIdentity {
+	bootID, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		log.Warnf("Failed to read boot id: %s", err)
+	}
+
+	// Tells apart instances that happen to run with the same hostname
+	nonce := make([]byte, 8)
+	if _, err = rand.Read(nonce); err != nil {
+		log.Warnf("Failed to generate instance nonce: %s", err)
+	}
+
+	return &nodeIdentity{
+		Hostname:  hostname,
+		BootID:    strings.TrimSpace(string(bootID)),
+		PID:       os.Getpid(),
+		Version:   version,
+		StartedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+}
+
+// Returns true if both identities describe the same run of the driver
+func (identity *nodeIdentity) sameIncarnation(other *nodeIdentity) bool {
+	return identity.Hostname == other.Hostname &&
+		identity.BootID == other.BootID &&
+		identity.PID == other.PID &&
+		identity.StartedAt == other.StartedAt
+}
+
+// Returns true if the identity belongs to an earlier run of the driver on this node.
+// Only meaningful for identities with the same hostname as ours.
+func (identity *nodeIdentity) isPreviousIncarnation() bool {
+	if identity.BootID == "" || identity.BootID != self.BootID {
+		// Unknown or the node was rebooted since
+		return true
+	}
+
+	if identity.PID == self.PID {
+		// Either us, or a run that had our PID before us
+		return identity.StartedAt != self.StartedAt
+	}
+
+	// Another process on the same boot, is it still running?
+	err := syscall.Kill(identity.PID, 0)
+	return err != nil && err != syscall.EPERM
+}
+
+// Returns true if the mount of this hostname was left behind by a previous run of this node.
+// A mount written on another boot may as well belong to a second node running with
+// the same hostname. It is only taken for ours if its heartbeat expired, or if our previous run
+// was the last to write the lock file of this hostname, read before it was locked again.
+func (volume *sharedVolume) isLeftBehind(mount *volumeMount, lock *volumeLock) bool {
+	owner := mount.owner()
+	if !owner.isPreviousIncarnation() {
+		return false
+	}
+
+	if owner.BootID != "" && owner.BootID == self.BootID {
+		// The boot id is random, only this node could have written it
+		return true
+	}
+
+	if volume.isMountExpired(mount) {
+		return true
+	}
+
+	return lock != nil && lock.identity != nil && previousNonce != "" && lock.identity.Nonce == previousNonce
+}
+
+// Returned when another driver instance overwrote one of our lock files
+type identityConflictError struct {
+	volume string
+	other  nodeIdentity
+}
+
+func (err *identityConflictError) Error() string {
+	return fmt.Sprintf("Another driver instance with hostname %s (pid %d, boot id %s, started at %s) is writing the lock file of volume %s",
+		err.other.Hostname, err.other.PID, err.other.BootID, err.other.StartedAt, err.volume)
+}
+
+// Returns a random version 4 UUID
+func newUUID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// Remembers that a different instance was seen using our hostname.
+// There is no safe way to continue mounting volumes until it is resolved.
+type hostnameConflict struct {
+	mutex *sync.Mutex
+	err   error
+}
+
+func newHostnameConflict() *hostnameConflict {
+	return &hostnameConflict{
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (conflict *hostnameConflict) set(err error) {
+	conflict.mutex.Lock()
+	defer conflict.mutex.Unlock()
+
+	conflict.err = err
+}
+
+func (conflict *hostnameConflict) get() error {
+	conflict.mutex.Lock()
+	defer conflict.mutex.Unlock()
+
+	return conflict.err
+}
@@ -0,0 +1,143 @@
+// +build linux
+
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestPreviousIncarnationsOfTheNode(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	if self.isPreviousIncarnation() {
+		t.Fatal("Running driver is taken for a previous incarnation")
+	}
+
+	restarted := *self
+	restarted.StartedAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+
+	rebooted := *self
+	rebooted.BootID = "rebooted"
+
+	// A process of this boot that exited
+	process := exec.Command("true")
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	exited := *self
+	exited.PID = process.Process.Pid
+
+	for name, identity := range map[string]nodeIdentity{"restarted": restarted, "rebooted": rebooted, "exited": exited} {
+		if !identity.isPreviousIncarnation() {
+			t.Errorf("Driver that %s is taken for a running one", name)
+		}
+		if identity.sameIncarnation(self) {
+			t.Errorf("Driver that %s is taken for this one", name)
+		}
+	}
+}
+
+func TestSecondInstanceWithTheSameHostnameStopsMounts(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	driver := newTestDriver()
+	driver.addVolume(createTestVolume(t, "data", volumeMetadata{}))
+
+	// Another driver is started with the hostname h1
+	running := self
+	self = newNodeIdentity("h1")
+	attachTestVolume(t, "data")
+	self = running
+
+	driver.RefreshLocks()
+
+	if err := driver.conflict.get(); err == nil {
+		t.Fatal("Second instance with the same hostname was not detected")
+	}
+	if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: "c1"}); err == nil {
+		t.Fatal("Volume was mounted while another instance uses the hostname")
+	}
+}
+
+// Starts the driver of h1 again on a node with the boot id
+func restartTestHost(t *testing.T, bootID string) sharedVolumeDriver {
+	previousNonce = loadPreviousNonce()
+	self = newNodeIdentity("h1")
+	self.BootID = bootID
+	testIdentities["h1"] = self
+
+	driver := newTestDriver()
+	driver.Discover()
+	return driver
+}
+
+func TestDiscoverKeepsMountsOfAnotherNodeWithTheSameHostname(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	mount, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second machine is started with the hostname h1
+	stateDir = filepath.Join(*root, "_other")
+	driver := restartTestHost(t, "other-machine")
+
+	if !exists(mount.LockFilePath) {
+		t.Error("Live mount of another node with the same hostname was removed")
+	}
+	if err = driver.conflict.get(); err == nil {
+		t.Error("Hostname conflict was not reported")
+	}
+}
+
+func TestDiscoverRemovesMountsOfThePreviousRun(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	mount, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node rebooted, its previous run wrote the lock file
+	driver := restartTestHost(t, "rebooted")
+
+	if exists(mount.LockFilePath) {
+		t.Error("Mount of the previous run was kept")
+	}
+	if err = driver.conflict.get(); err != nil {
+		t.Errorf("Previous run was reported as a conflict: %s", err)
+	}
+}
+
+func TestDiscoverRemovesExpiredMountsOfAnotherBoot(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	mount, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mount.Heartbeat = time.Now().Add(-2 * lockTimeout).UTC().Format(time.RFC3339)
+	if err = locking.update(mount); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node lost its local state
+	stateDir = filepath.Join(*root, "_lost")
+	driver := restartTestHost(t, "rebooted")
+
+	if exists(mount.LockFilePath) {
+		t.Error("Expired mount of another boot was kept")
+	}
+	if err = driver.conflict.get(); err != nil {
+		t.Errorf("Expired mount was reported as a conflict: %s", err)
+	}
+}
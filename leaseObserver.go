@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Lock age is the difference between the timestamp written into the
+	// lock file by its owner and the local wall clock.
+	leaseModeTimestamp = "timestamp"
+	// Lock age is the time since the lock file was last seen changing,
+	// measured on the local monotonic clock.
+	leaseModeObserve = "observe"
+)
+
+// Keeps track of when lock files were last seen changing.
+// Observations are made locally, so the ages do not depend on
+// the clocks of the other nodes agreeing with ours.
+type leaseObserver struct {
+	mutex        *sync.Mutex
+	observations map[string]*leaseObservation
+}
+
+type leaseObservation struct {
+	content   string
+	modTime   time.Time
+	changedAt time.Time
+}
+
+var observer = newLeaseObserver()
+
+func newLeaseObserver() *leaseObserver {
+	return &leaseObserver{
+		mutex:        &sync.Mutex{},
+		observations: make(map[string]*leaseObservation),
+	}
+}
+
+// Records the current state of a lock file and returns
+// how long ago it was last seen changing.
+// A file that was not observed before counts as just changed.
+func (observer *leaseObserver) observe(filename string, content string, modTime time.Time) time.Duration {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+
+	// time.Now() carries a monotonic reading, so time.Since is not affected
+	// by wall clock adjustments
+	now := time.Now()
+
+	observation, ok := observer.observations[filename]
+	if !ok || observation.content != content || !observation.modTime.Equal(modTime) {
+		observation = &leaseObservation{
+			content:   content,
+			modTime:   modTime,
+			changedAt: now,
+		}
+		observer.observations[filename] = observation
+	}
+
+	return now.Sub(observation.changedAt)
+}
+
+// Drops the observations of a lock file that no longer exists
+func (observer *leaseObserver) forget(filename string) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+
+	delete(observer.observations, filename)
+}
+
+// How long a waiter has to keep watching a lock before it can decide that it is stale.
+// When observing, the clock only starts at the first observation.
+func (volume *sharedVolume) leaseWaitTime() time.Duration {
+	if leaseMode == leaseModeObserve {
+		return 2 * volume.lockTimeout()
+	}
+	return volume.lockTimeout()
+}
@@ -0,0 +1,42 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObservedLeasesIgnoreTheClocksOfOtherHosts(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	leaseMode = leaseModeObserve
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock of h1 is far behind, but the lock is seen for the first time
+	ageTestLock(t, volume, "h1", time.Hour, false)
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	locking.cleanup(other)
+
+	if !exists(other.GetLockFileFor("h1")) || !exists(other.getExclusiveMountFile()) {
+		t.Fatal("Lock that was just observed was removed")
+	}
+
+	// The lock has not changed for longer than the lock timeout
+	observer.mutex.Lock()
+	for _, observation := range observer.observations {
+		observation.changedAt = observation.changedAt.Add(-2 * lockTimeout)
+	}
+	observer.mutex.Unlock()
+
+	locking.cleanup(other)
+
+	if exists(other.GetLockFileFor("h1")) || exists(other.getExclusiveMountFile()) {
+		t.Error("Lock that stopped changing was kept")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	lockBackendFile  = "lockfile"
+	lockBackendFlock = "flock"
+)
+
+// A lock backend decides how volumes are locked into existence
+// and how mount files are acquired, released and taken over.
+// Every node sharing a root has to use the same backend.
+type lockBackend interface {
+	// Locks the volume on behalf of this host, or refreshes an existing lock
+	lock(volume *sharedVolume) error
+	// Releases the lock of this host
+	unlock(volume *sharedVolume) error
+	// Returns true if any host holds a lock on the volume
+	isLocked(volume *sharedVolume) (bool, error)
+	// Creates the mount file. Fails with an os.IsExist error if it is already taken.
+	acquire(mount *volumeMount) error
+	// Replaces the content of a mount file this host holds
+	update(mount *volumeMount) error
+	// Removes the mount file
+	release(mount *volumeMount) error
+	// Removes the mount file if its holder is gone. Returns true if it was removed.
+	reclaim(volume *sharedVolume, mount *volumeMount) (bool, error)
+	// Returns true if the host still holds a live lock on the volume
+	isAlive(volume *sharedVolume, host string) bool
+	// Removes locks and mounts of hosts that are gone
+	cleanup(volume *sharedVolume)
+}
+
+var locking lockBackend = newLockFileBackend()
+
+// Returns the file recording the lock backend of the root
+func getLockBackendFile() string {
+	return filepath.Join(*root, "_backend")
+}
+
+// Records the lock backend in the root if no node did so yet, and returns an error
+// if the root uses a different backend. Nodes locking the same files in different
+// ways don't see each other's locks.
+func checkLockBackend(name string) error {
+	filename := getLockBackendFile()
+
+	content, err := fsReadFile(filename)
+	if os.IsNotExist(err) {
+		if err = fsCreateFile(filename, []byte(name+"\n"), 0644); err == nil {
+			return nil
+		}
+
+		// Another node recorded its backend first
+		if os.IsExist(err) {
+			content, err = fsReadFile(filename)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to read the lock backend of the root: %s", err)
+	}
+
+	if recorded := strings.TrimSpace(string(content)); recorded != name {
+		return fmt.Errorf("The root uses the %s lock backend, this node is configured for %s", recorded, name)
+	}
+
+	return nil
+}
+
+func newLockBackend(name string) (lockBackend, error) {
+	switch name {
+	case lockBackendFile:
+		return newLockFileBackend(), nil
+	case lockBackendFlock:
+		return newFlockBackend(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown lock backend %s", name)
+}
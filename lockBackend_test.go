@@ -0,0 +1,318 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+var testLockBackends = []string{lockBackendFile, lockBackendFlock}
+
+// Runs the test once for every lock backend
+func forEachBackend(t *testing.T, test func(t *testing.T)) {
+	for _, backend := range testLockBackends {
+		t.Run(backend, func(t *testing.T) {
+			defer setupTestRoot(t, backend)()
+			test(t)
+		})
+	}
+}
+
+// Stops the host as if it crashed. The kernel drops the flocks of a dead process,
+// the lock file of a host that stopped refreshing it times out.
+func crashTestHost(t *testing.T, volume *sharedVolume, host string) {
+	switch backend := testBackends[host].(type) {
+	case *flockBackend:
+		backend.mutex.Lock()
+		for filename, file := range backend.files {
+			file.Close()
+			delete(backend.files, filename)
+		}
+		backend.mutex.Unlock()
+	case *lockFileBackend:
+		ageTestLock(t, volume, host, 2*lockTimeout, false)
+	}
+}
+
+func TestBackendMismatchIsRefused(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	if err := checkLockBackend(lockBackendFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node configured for flock must not lock the files of lockfile nodes
+	if err := checkLockBackend(lockBackendFlock); err == nil {
+		t.Fatal("The flock backend was accepted on a root using the lockfile backend")
+	}
+
+	wait := false
+	createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+
+	lockBackendName = lockBackendFlock
+	driver := newTestDriver()
+	if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: "c1"}); err == nil {
+		t.Fatal("Mounted a volume with a lock backend the root does not use")
+	}
+	if exists(filepath.Join(*root, "data", "_locks", "exclusive.mount")) {
+		t.Fatal("The refused mount created a mount file")
+	}
+}
+
+func TestBackendLocksVolume(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		volume := createTestVolume(t, "data", volumeMetadata{})
+
+		setTestHost(t, "h2")
+		other := attachTestVolume(t, "data")
+		if err := other.unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		if locked, err := other.isLocked(); err != nil || !locked {
+			t.Fatalf("Volume locked by h1 is not locked: %v", err)
+		}
+
+		setTestHost(t, "h1")
+		if err := volume.unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestHost(t, "h2")
+		if locked, err := other.isLocked(); err != nil || locked {
+			t.Fatalf("Volume is still locked after h1 unlocked it: %v", err)
+		}
+	})
+}
+
+func TestBackendExclusiveMount(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		wait := false
+		volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+		if _, err := mountTestVolume(volume, "c1"); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestHost(t, "h2")
+		other := attachTestVolume(t, "data")
+		if _, err := mountTestVolume(other, "c2"); err == nil {
+			t.Fatal("Exclusive volume was mounted by two hosts")
+		}
+
+		setTestHost(t, "h1")
+		if err := volume.unmount("c1"); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestHost(t, "h2")
+		if _, err := mountTestVolume(other, "c2"); err != nil {
+			t.Fatalf("Released volume could not be mounted: %s", err)
+		}
+	})
+}
+
+func TestBackendTakesOverFromCrashedHost(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		wait := false
+		volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+		if _, err := mountTestVolume(volume, "c1"); err != nil {
+			t.Fatal(err)
+		}
+
+		crashTestHost(t, volume, "h1")
+
+		setTestHost(t, "h2")
+		other := attachTestVolume(t, "data")
+		mount, err := mountTestVolume(other, "c2")
+		if err != nil {
+			t.Fatalf("Volume of a crashed host was not taken over: %s", err)
+		}
+		if mount.Hostname != "h2" {
+			t.Fatalf("Mount is held by %s", mount.Hostname)
+		}
+
+		if other.Epoch <= volume.Epoch {
+			t.Errorf("Fencing token %d of the takeover is not larger than %d", other.Epoch, volume.Epoch)
+		}
+	})
+}
+
+func TestBackendCleanupKeepsLiveHosts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+		if _, err := mountTestVolume(volume, "c1"); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestHost(t, "h2")
+		other := attachTestVolume(t, "data")
+		locking.cleanup(other)
+
+		if !exists(other.GetLockFileFor("h1")) {
+			t.Error("Lock of a live host was removed")
+		}
+		if !exists(other.getExclusiveMountFile()) {
+			t.Error("Mount of a live host was removed")
+		}
+	})
+}
+
+func TestFlockCleanupRemovesFilesNoOneHolds(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFlock)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	crashTestHost(t, volume, "h1")
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	locking.cleanup(other)
+
+	if exists(other.GetLockFileFor("h1")) || exists(other.getExclusiveMountFile()) {
+		t.Fatal("Files of a crashed host were kept")
+	}
+	if !exists(other.GetLockFileFor("h2")) {
+		t.Fatal("Lock of the host running the cleanup was removed")
+	}
+
+	// The cleanup gave up the locks it removed the files under
+	if _, err := mountTestVolume(other, "c2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonedFlockIsReleased(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFlock)()
+	defer func(timeout time.Duration) { ioTimeout = timeout }(ioTimeout)
+	ioTimeout = 10 * time.Millisecond
+
+	filename := filepath.Join(*root, "test.mount")
+
+	// The server answers only after the call was given up
+	hung := make(chan struct{})
+	_, err := filesystem.call("flock", filename, func() (interface{}, error) {
+		<-hung
+		return flockFile(filename, syscall.LOCK_EX)
+	})
+	if err == nil {
+		t.Fatal("Call did not time out")
+	}
+	close(hung)
+
+	for deadline := time.Now().Add(5 * time.Second); filesystem.status() != ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("Abandoned call did not return")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if held, err := probeFlock(filename); err != nil || held {
+		t.Fatalf("Lock taken by an abandoned call is still held: %v", err)
+	}
+}
+
+// Environment of a host process started by startTestHostProcess
+const (
+	testHelperRootEnv = "SFS_TEST_HELPER_ROOT"
+	testHelperHostEnv = "SFS_TEST_HELPER_HOST"
+)
+
+// Not a test of its own: runs as the process of another host, started by startTestHostProcess.
+// It mounts the volume with the flock backend and then waits to be killed.
+func TestHelperHostProcess(t *testing.T) {
+	dir := os.Getenv(testHelperRootEnv)
+	if dir == "" {
+		return
+	}
+
+	*root = dir
+	testBackend = lockBackendFlock
+	testIdentities = make(map[string]*nodeIdentity)
+	testBackends = make(map[string]lockBackend)
+	setTestHost(t, os.Getenv(testHelperHostEnv))
+
+	volume := attachTestVolume(t, "data")
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("mounted")
+
+	time.Sleep(time.Minute)
+	os.Exit(1)
+}
+
+// Runs the test binary again as the process of the host, which mounts the volume
+func startTestHostProcess(t *testing.T, host string) *exec.Cmd {
+	helper := exec.Command(os.Args[0], "-test.run=^TestHelperHostProcess$")
+	helper.Env = append(os.Environ(), testHelperRootEnv+"="+*root, testHelperHostEnv+"="+host)
+
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimSpace(line) == "mounted" {
+			return helper
+		}
+		if err != nil {
+			helper.Process.Kill()
+			helper.Wait()
+			t.Fatalf("Process of host %s did not mount the volume: %s", host, line)
+		}
+	}
+}
+
+func TestFlockIsReleasedWhenTheHostProcessDies(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFlock)()
+
+	setTestHost(t, "h2")
+	wait := false
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+
+	helper := startTestHostProcess(t, "h1")
+	defer helper.Process.Kill()
+
+	if !locking.isAlive(volume, "h1") {
+		t.Fatal("Lock of a running host process is not held")
+	}
+	if _, err := mountTestVolume(volume, "c2"); err == nil {
+		t.Fatal("Volume mounted by another host process was mounted")
+	}
+
+	// The kernel drops the locks of the dead process
+	if err := helper.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	helper.Wait()
+
+	if locking.isAlive(volume, "h1") {
+		t.Error("Lock of a killed host process is still held")
+	}
+
+	mount, err := mountTestVolume(volume, "c2")
+	if err != nil {
+		t.Fatalf("Volume of a killed host process was not taken over: %s", err)
+	}
+	if mount.Hostname != "h2" {
+		t.Errorf("Mount is held by %s", mount.Hostname)
+	}
+}
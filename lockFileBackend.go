@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Every host periodically writes a timestamp into its lock file.
+// Locks that were not refreshed within the lock timeout are considered stale
+// and the mounts of their hosts can be taken over.
+type lockFileBackend struct {
+}
+
+func newLockFileBackend() *lockFileBackend {
+	return &lockFileBackend{}
+}
+
+func (backend *lockFileBackend) lock(volume *sharedVolume) error {
+	return volume.writeLockFile()
+}
+
+func (backend *lockFileBackend) unlock(volume *sharedVolume) error {
+	return volume.removeLockFile()
+}
+
+func (backend *lockFileBackend) isLocked(volume *sharedVolume) (bool, error) {
+	locksDir := volume.GetLocksDir()
+
+	files, err := fsReadDir(locksDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".lock" {
+			// We are only interested if such a file exists
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (backend *lockFileBackend) acquire(mount *volumeMount) error {
+	return mount.save()
+}
+
+func (backend *lockFileBackend) update(mount *volumeMount) error {
+
+	// Another host may have reclaimed the mount in the meantime
+	current := &volumeMount{LockFilePath: mount.LockFilePath}
+	if err := current.load(); err != nil {
+		return err
+	}
+
+	// A host exclusive mount is renamed to one of its remaining ids when its first id unmounts
+	sameMount := current.MountID == mount.MountID || current.hasMountID(mount.MountID)
+
+	if !sameMount || !current.owner().sameIncarnation(mount.owner()) {
+		return fmt.Errorf("Mount file %s was taken over by mount %s on host %s", mount.LockFilePath, current.MountID, current.Hostname)
+	}
+
+	return mount.overwrite()
+}
+
+func (backend *lockFileBackend) release(mount *volumeMount) error {
+	return mount.remove()
+}
+
+func (backend *lockFileBackend) reclaim(volume *sharedVolume, mount *volumeMount) (bool, error) {
+
+	// Check the host's lockfile and look for a timeout
+	lock, err := volume.getLock(mount.Hostname)
+	if err != nil {
+		log.Errorf("Failed to load lock file for volume %s", volume.Name)
+		return false, nil
+	}
+
+	// A host that restarted since it created the mount refreshes its lock,
+	// but the mount belongs to a run that is gone.
+	if lock != nil && lock.identity != nil && mount.BootID != "" && !lock.identity.sameIncarnation(mount.owner()) {
+		log.Infof("Host %s restarted since mounting volume %s, reclaiming mount %s", mount.Hostname, volume.Name, mount.MountID)
+		lock = nil
+	}
+
+	// The host shut down cleanly and left no mounts behind
+	if lock != nil && lock.released {
+		log.Infof("Host %s released volume %s, reclaiming mount %s", mount.Hostname, volume.Name, mount.MountID)
+		lock = nil
+	}
+
+	// The host is alive, but no container used the mount for too long
+	if lock != nil && volume.isMountExpired(mount) {
+		if err = volume.checkClockSkew(lock); err != nil {
+			log.Error(err)
+			return false, err
+		}
+
+		log.Infof("Mount %s of volume %s on host %s expired, reclaiming it", mount.MountID, volume.Name, mount.Hostname)
+		lock = nil
+	}
+
+	// If the file exist, did it time out already?
+	if lock != nil {
+		if lock.age() >= volume.lockTimeout() {
+			// Don't trust the timeout if the clocks disagree
+			if err = volume.checkClockSkew(lock); err != nil {
+				log.Error(err)
+				return false, err
+			}
+		}
+
+		if ok, err := lock.tryUnlock(); err != nil {
+			// Something went wrong during remove
+			// This is not normal operation
+			return false, err
+		} else if ok {
+			// The lock file was timed out, so we have removed it
+			lock = nil
+		}
+	}
+
+	// If the lock file does not exist, or was removed
+	if lock == nil {
+		// Try to remove the mount file
+		if err = mount.remove(); err != nil {
+			// The mount is not actually locked, something else is wrong here...
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (backend *lockFileBackend) isAlive(volume *sharedVolume, host string) bool {
+	lock, err := volume.getLock(host)
+	if err != nil {
+		// If it cannot be checked it is better to assume it is alive
+		return true
+	}
+
+	return lock != nil && !lock.released && lock.age() < volume.lockTimeout()
+}
+
+func (backend *lockFileBackend) cleanup(volume *sharedVolume) {
+
+	locks := volume.getLocks()
+
+	for id, lock := range locks {
+		if lock == nil {
+			delete(locks, id)
+			continue
+		}
+
+		// Don't trust the timeout if the clocks disagree, the lock and its mounts are kept
+		if lock.age() >= volume.lockTimeout() {
+			if err := volume.checkClockSkew(lock); err != nil {
+				log.Warn(err)
+				continue
+			}
+		}
+
+		if ok, _ := lock.tryUnlock(); ok {
+			delete(locks, id)
+		}
+	}
+
+	mounts := volume.getMounts()
+
+	for _, mount := range mounts {
+		if lock, ok := locks[mount.Hostname]; !ok {
+			mount.remove()
+		} else if mount.Hostname != *hostname && volume.isMountExpired(mount) && volume.checkClockSkew(lock) == nil {
+			// The holder releases its own expired mounts
+			log.Infof("Removing expired mount %s of volume %s on host %s", mount.MountID, volume.Name, mount.Hostname)
+			mount.remove()
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,14 +15,25 @@ import (
 )
 
 var (
-	root             = flag.String("root", "", "Base directory where volumes are created in the cluster")
-	debug            = flag.Bool("debug", true, "Enable verbose logging")
-	hostname         = flag.String("hostname", "", "The hostname used in locking operations")
-	lockInterval     = 20 * time.Second
-	lockTimeout      = 60 * time.Second
-	cleanupInterval  = 60 * time.Minute
-	defaultProtected = false
-	defaultExclusive = false
+	version           = "0.1.0"
+	root              = flag.String("root", "", "Base directory where volumes are created in the cluster")
+	debug             = flag.Bool("debug", true, "Enable verbose logging")
+	hostname          = flag.String("hostname", "", "The hostname used in locking operations")
+	lockInterval      = 20 * time.Second
+	lockTimeout       = 60 * time.Second
+	cleanupInterval   = 60 * time.Minute
+	leaseMode         = leaseModeTimestamp
+	maxClockSkew      = 10 * time.Second
+	lockBackendName   = lockBackendFile
+	dockerSocket      = "/var/run/docker.sock"
+	handoverHook      = ""
+	stateDir          = "/var/lib/docker-volume-sharedfs"
+	reconcileInterval = time.Duration(0)
+	ioTimeout         = 10 * time.Second
+	ioDegradeAfter    = 3
+	removeTimeout     = 10 * time.Minute
+	defaultProtected  = false
+	defaultExclusive  = false
 )
 
 func main() {
@@ -37,13 +50,38 @@ func main() {
 		*hostname, _ = os.Hostname()
 	}
 
-	log.Debugf("Starting with hostname=%s; root=%s", *hostname, *root)
+	self = newNodeIdentity(*hostname)
+	previousNonce = loadPreviousNonce()
+
+	log.Debugf("Starting with hostname=%s; root=%s; lock backend=%s", *hostname, *root, lockBackendName)
+
+	var err error
+	if locking, err = newLockBackend(lockBackendName); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkLockBackend(lockBackendName); err != nil {
+		log.Fatal(err)
+	}
 
 	// userID, _ := user.Lookup("root")
 	// groupID, _ := strconv.Atoi(userID.Gid)
 
+	engine = newDockerEngine(dockerSocket)
+
 	driver := newSharedFSDriver(*root)
 	handler := volume.NewHandler(driver)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		received := <-signals
+		log.Infof("Received %s, shutting down", received)
+
+		driver.Shutdown()
+		os.Exit(0)
+	}()
+
 	fmt.Println(handler.ServeUnix("sharedfs", 0))
 }
 
@@ -64,6 +102,58 @@ func parseEnvironment() {
 		lockTimeout = time.Duration(parsedInt) * time.Second
 	}
 
+	value = os.Getenv("SFS_LEASE_MODE")
+	switch value {
+	case leaseModeTimestamp, leaseModeObserve:
+		leaseMode = value
+	case "":
+	default:
+		log.Warnf("Unknown lease mode %s, using %s", value, leaseMode)
+	}
+
+	value = os.Getenv("SFS_MAX_CLOCK_SKEW")
+	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
+		maxClockSkew = time.Duration(parsedInt) * time.Second
+	}
+
+	value = os.Getenv("SFS_LOCK_BACKEND")
+	if value != "" {
+		lockBackendName = value
+	}
+
+	if value, ok := os.LookupEnv("SFS_DOCKER_SOCKET"); ok {
+		dockerSocket = value
+	}
+
+	value = os.Getenv("SFS_HANDOVER_HOOK")
+	if value != "" {
+		handoverHook = value
+	}
+
+	if value, ok := os.LookupEnv("SFS_STATE_DIR"); ok {
+		stateDir = value
+	}
+
+	value = os.Getenv("SFS_RECONCILE_INTERVAL")
+	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
+		reconcileInterval = time.Duration(parsedInt) * time.Second
+	}
+
+	value = os.Getenv("SFS_IO_TIMEOUT")
+	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
+		ioTimeout = time.Duration(parsedInt) * time.Second
+	}
+
+	value = os.Getenv("SFS_IO_DEGRADE_AFTER")
+	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
+		ioDegradeAfter = int(parsedInt)
+	}
+
+	value = os.Getenv("SFS_REMOVE_TIMEOUT")
+	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
+		removeTimeout = time.Duration(parsedInt) * time.Second
+	}
+
 	value = os.Getenv("SFS_CLEANUP_INTERVAL")
 	if parsedInt, err := strconv.ParseInt(value, 10, 32); err == nil {
 		cleanupInterval = time.Duration(parsedInt) * time.Minute
@@ -0,0 +1,131 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+// The tests run several hosts sharing a root in one process. Each host has its own
+// identity and lock backend, the globals are switched with setTestHost.
+var (
+	testBackend    string
+	testIdentities map[string]*nodeIdentity
+	testBackends   map[string]lockBackend
+)
+
+// Points the driver at a new temporary root using the lock backend.
+// The returned function removes the root again.
+func setupTestRoot(t *testing.T, backend string) func() {
+	dir, err := ioutil.TempDir("", "sharedfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*root = dir
+	engine = nil
+	leaseMode = leaseModeTimestamp
+	maxClockSkew = 10 * time.Second
+	filesystem = newSharedFilesystem()
+
+	testBackend = backend
+	lockBackendName = backend
+	stateDir = filepath.Join(dir, "_state")
+	previousNonce = ""
+	savedNonce = ""
+	testIdentities = make(map[string]*nodeIdentity)
+	testBackends = make(map[string]lockBackend)
+	setTestHost(t, "h1")
+
+	return func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// Makes the following calls act as the host
+func setTestHost(t *testing.T, name string) {
+	if _, ok := testIdentities[name]; !ok {
+		backend, err := newLockBackend(testBackend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testIdentities[name] = newNodeIdentity(name)
+		testBackends[name] = backend
+	}
+
+	*hostname = name
+	self = testIdentities[name]
+	locking = testBackends[name]
+}
+
+// Creates a driver without the background routines
+func newTestDriver() sharedVolumeDriver {
+	return sharedVolumeDriver{
+		volumes:  make(map[string]*sharedVolume),
+		mutex:    &sync.RWMutex{},
+		root:     *root,
+		hostname: *hostname,
+		conflict: newHostnameConflict(),
+		stop:     make(chan struct{}),
+		routines: &sync.WaitGroup{},
+
+		handovers: make(map[string]string),
+	}
+}
+
+// Creates a volume on the current host and locks it
+func createTestVolume(t *testing.T, name string, metadata volumeMetadata) *sharedVolume {
+	volume := &sharedVolume{
+		Volume: &dockerVolume.Volume{
+			Name:       name,
+			Mountpoint: filepath.Join(*root, name),
+			CreatedAt:  time.Now().Format(time.RFC3339),
+		},
+		volumeMetadata: metadata,
+	}
+
+	if err := volume.createDirectoryStructure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := volume.saveMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if err := volume.lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	return volume
+}
+
+// Reads a volume created by another host and locks it on the current host
+func attachTestVolume(t *testing.T, name string) *sharedVolume {
+	volume, err := readVolume(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = volume.lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	return volume
+}
+
+// Mounts the volume on the current host the way the driver does
+func mountTestVolume(volume *sharedVolume, id string) (*volumeMount, error) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+
+	return volume.mount(id)
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -1,55 +1,191 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 func (driver sharedVolumeDriver) MaintenanceRoutine() {
+	defer driver.routines.Done()
 
-	lockTicker := time.NewTicker(lockInterval)
+	lockTimer := time.NewTimer(driver.refreshInterval())
 	cleanupTicker := time.NewTicker(cleanupInterval)
 
 	for {
 
 		select {
-		case <-lockTicker.C:
-			driver.RefreshLocks()
+		case <-lockTimer.C:
+			// While the root is degraded its calls fail anyway
+			if filesystem.probe(driver.root) {
+				driver.ReconcileBookkeeping()
+				driver.RefreshLocks()
+				driver.CheckClockSkew()
+				driver.HandleHandovers()
+			}
+			lockTimer.Reset(driver.refreshInterval())
 		case <-cleanupTicker.C:
 			driver.Cleanup()
+		case <-driver.stop:
+			lockTimer.Stop()
+			cleanupTicker.Stop()
+			return
 		}
 	}
 }
 
+// Locks are refreshed at least three times within the strictest lock timeout
+// of the volumes this node holds.
+func (driver sharedVolumeDriver) refreshInterval() time.Duration {
+	interval := lockInterval
+
+	for _, volume := range driver.snapshot() {
+		volume.mutex.Lock()
+		volumeInterval := volume.lockTimeout() / 3
+		volume.mutex.Unlock()
+
+		if volumeInterval < interval {
+			interval = volumeInterval
+		}
+	}
+
+	return interval
+}
+
+// Matches the bookkeeping with the volumes in the root, which other nodes may have
+// removed, recreated or changed. Volumes that are gone are dropped from the bookkeeping,
+// so their locks are not written into directories that no longer exist.
+func (driver sharedVolumeDriver) ReconcileBookkeeping() {
+	for _, volume := range driver.snapshot() {
+		driver.reconcileBookkeeping(volume)
+	}
+}
+
+func (driver sharedVolumeDriver) reconcileBookkeeping(volume *sharedVolume) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+
+	name := volume.Name
+
+	loaded, err := readVolume(name)
+	if err != nil {
+		// Keep the volume if the root is only unavailable for a moment
+		if _, statErr := fsStat(volume.GetMetaFile()); os.IsNotExist(statErr) {
+			if driver.removeVolume(volume) {
+				emitVolumeEvent(volumeEventRemoved, name, fmt.Sprintf("Volume %s was removed by another node", name))
+			}
+		}
+		return
+	}
+
+	if !loaded.sameIdentity(volume) {
+		if err = loaded.lock(); err != nil {
+			log.Warnf("Failed to lock recreated volume %s: %s", name, err)
+		}
+		if driver.replaceVolume(volume, loaded) {
+			emitVolumeEvent(volumeEventRecreated, name, fmt.Sprintf("Volume %s was recreated by another node", name))
+		}
+		return
+	}
+
+	if loaded.options() != volume.options() {
+		volume.volumeMetadata = loaded.volumeMetadata
+		emitVolumeEvent(volumeEventChanged, name, fmt.Sprintf("Options of volume %s were changed: %s", name, volume.options()))
+	}
+}
+
 func (driver sharedVolumeDriver) RefreshLocks() {
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
+	for _, volume := range driver.snapshot() {
+		volume.mutex.Lock()
 
-	for _, volume := range driver.volumes {
-		volume.lock()
+		if err := volume.lock(); err != nil {
+			if _, ok := err.(*identityConflictError); ok {
+				log.Errorf("HOSTNAME CONFLICT: %s. Mounting is disabled until the conflict is resolved and the driver restarted.", err)
+				driver.conflict.set(err)
+			} else {
+				log.Warnf("Failed to refresh lock of volume %s: %s", volume.Name, err)
+			}
+		}
+
+		driver.refreshMounts(volume)
+
+		if err := volume.refreshOwner(); err != nil {
+			log.Warnf("Failed to refresh the owner of volume %s: %s", volume.Name, err)
+		}
+
+		volume.mutex.Unlock()
 	}
 }
 
 // For each volume remove mounts that
 func (driver sharedVolumeDriver) Cleanup() {
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
+	for _, volume := range driver.snapshot() {
+		volume.mutex.Lock()
+		locking.cleanup(volume)
+		volume.mutex.Unlock()
+	}
+}
 
-	for _, volume := range driver.volumes {
+// Stops the maintenance and gives up what this node no longer needs.
+// Mounts of containers that are still attached are kept,
+// those are left to time out as if the node had crashed.
+func (driver sharedVolumeDriver) Shutdown() {
+	close(driver.stop)
 
-		locks := volume.getLocks()
+	// A pass that is still running would refresh what is released below
+	driver.routines.Wait()
 
-		for id, lock := range locks {
-			if ok, _ := lock.tryUnlock(); ok {
-				delete(locks, id)
-			}
+	for _, volume := range driver.snapshot() {
+		driver.shutdownVolume(volume)
+	}
+}
+
+// Returns true once the driver is shutting down
+func (driver sharedVolumeDriver) stopping() bool {
+	select {
+	case <-driver.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (driver sharedVolumeDriver) shutdownVolume(volume *sharedVolume) {
+	// Wait for a mount that might be working on the volume
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+
+	attached, err := driver.volumeContainers(volume)
+	if err != nil {
+		log.Warnf("Cannot tell if volume %s is still in use, keeping its mounts: %s", volume.Name, err)
+		return
+	}
+
+	// Mounts of containers that are no longer attached are released one by one
+	for _, mount := range volume.getMounts() {
+		if mount.Hostname != *hostname {
+			continue
 		}
 
-		mounts := volume.getMounts()
+		if mount.isAttached(attached) && !mount.owner().isPreviousIncarnation() {
+			log.Infof("Mount %s of volume %s is still in use, keeping it", mount.MountID, volume.Name)
+			continue
+		}
 
-		for _, mount := range mounts {
-			if _, ok := locks[mount.Hostname]; !ok {
-				mount.remove()
-			}
+		log.Infof("Releasing mount %s of volume %s", mount.MountID, volume.Name)
+		if err := volume.releaseMount(mount); err != nil {
+			log.Warnf("Failed to release mount %s of volume %s: %s", mount.MountID, volume.Name, err)
 		}
 	}
+
+	if len(attached) > 0 {
+		log.Infof("Volume %s is still in use, keeping its lock", volume.Name)
+		return
+	}
+
+	if err := volume.releaseLockFile(); err != nil {
+		log.Warnf("Failed to release lock of volume %s: %s", volume.Name, err)
+	}
 }
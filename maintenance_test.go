@@ -0,0 +1,115 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForTheMaintenance(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	defer func(interval time.Duration) { lockInterval = interval }(lockInterval)
+	_, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	// The maintenance refreshes the lock all the time
+	lockInterval = time.Millisecond
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	driver.routines.Add(1)
+	go driver.MaintenanceRoutine()
+	time.Sleep(20 * time.Millisecond)
+
+	driver.Shutdown()
+	time.Sleep(20 * time.Millisecond)
+
+	lock, err := volume.getLock(*hostname)
+	if err != nil || lock == nil {
+		t.Fatalf("Failed to read the lock: %v", err)
+	}
+	if !lock.released {
+		t.Error("Lock was refreshed after the shutdown released it")
+	}
+}
+
+func TestShutdownReleasesMountsThatAreNotInUse(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	driver := newTestDriver()
+	unused := createTestVolume(t, "unused", volumeMetadata{})
+	used := createTestVolume(t, "used", volumeMetadata{})
+	driver.addVolume(unused)
+	driver.addVolume(used)
+
+	// The container of the first volume was removed while the driver was running
+	released, err := mountTestVolume(unused, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := fake.addContainer("c2", "running", "used")
+	kept, err := mountTestVolume(used, "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used.recordContainer(kept, &container)
+
+	driver.Shutdown()
+
+	if exists(released.LockFilePath) {
+		t.Error("Mount of a volume that is not in use was kept")
+	}
+	if lock, err := unused.getLock(*hostname); err != nil || lock == nil || !lock.released {
+		t.Errorf("Lock of a volume that is not in use was not released: %v", err)
+	}
+
+	if !exists(kept.LockFilePath) {
+		t.Error("Mount of a running container was released")
+	}
+	if lock, err := used.getLock(*hostname); err != nil || lock == nil || lock.released {
+		t.Errorf("Lock of a volume that is in use was released: %v", err)
+	}
+}
+
+func TestShutdownReleasesMountsOfExitedContainers(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stopEngine := startFakeEngine(t)
+	defer stopEngine()
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	running := fake.addContainer("c1", "running", "data")
+	kept, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume.recordContainer(kept, &running)
+
+	// Docker never called unmount for the exited container
+	exited := fake.addContainer("c2", "running", "data")
+	released, err := mountTestVolume(volume, "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume.recordContainer(released, &exited)
+	fake.setState("c2", "exited")
+
+	driver.Shutdown()
+
+	if !exists(kept.LockFilePath) {
+		t.Error("Mount of a running container was released")
+	}
+	if exists(released.LockFilePath) {
+		t.Error("Mount of an exited container was kept")
+	}
+	if lock, err := volume.getLock(*hostname); err != nil || lock == nil || lock.released {
+		t.Errorf("Lock of a volume that is in use was released: %v", err)
+	}
+}
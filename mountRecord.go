@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The version of the mount file format written by this driver.
+// Version 1 added the mount time, the plugin version and the container using the mount,
+// version 2 the UUID of the volume. Files without a version were written by older drivers.
+const mountRecordSchema = 2
+
+// Labels Docker Swarm puts on the containers of a service
+const (
+	swarmServiceLabel = "com.docker.swarm.service.name"
+	swarmTaskLabel    = "com.docker.swarm.task.name"
+)
+
+// Records the container using the mount
+func (mount *volumeMount) describeContainer(container *dockerContainer) {
+	mount.ContainerID = container.ID
+	mount.ContainerName = ""
+	if len(container.Names) > 0 {
+		mount.ContainerName = strings.TrimPrefix(container.Names[0], "/")
+	}
+	mount.ServiceName = container.Labels[swarmServiceLabel]
+	mount.TaskName = container.Labels[swarmTaskLabel]
+}
+
+// Docker does not tell which container a mount is for. It is the container
+// using the volume that no other mount of this host is recorded for, if there is exactly one.
+func (volume *sharedVolume) findMountingContainer() *dockerContainer {
+	containers, err := engine.listContainers(map[string][]string{
+		"volume": {volume.Name},
+	}, true)
+	if err != nil {
+		log.Debugf("Cannot tell which container mounts volume %s: %s", volume.Name, err)
+		return nil
+	}
+
+	recorded := make(map[string]bool)
+	for _, mount := range volume.getMounts() {
+		if mount.Hostname == *hostname && mount.ContainerID != "" {
+			recorded[mount.ContainerID] = true
+		}
+	}
+
+	var found *dockerContainer
+	for i := range containers {
+		if !attachedContainerStates[containers[i].State] || recorded[containers[i].ID] {
+			continue
+		}
+
+		if found != nil {
+			return nil
+		}
+		found = &containers[i]
+	}
+
+	return found
+}
+
+// Records the container using a new mount, if it can be found
+func (volume *sharedVolume) recordContainer(mount *volumeMount, container *dockerContainer) {
+	if mount.ContainerID != "" || mount.Hostname != *hostname || engine == nil {
+		return
+	}
+
+	if container == nil {
+		if container = volume.findMountingContainer(); container == nil {
+			return
+		}
+	}
+
+	mount.describeContainer(container)
+
+	if err := locking.update(mount); err != nil {
+		log.Warnf("Failed to record the container of mount %s of volume %s: %s", mount.MountID, volume.Name, err)
+	}
+}
+
+// Renders the mount for the volume status
+func (mount *volumeMount) status() map[string]interface{} {
+	status := map[string]interface{}{
+		"id":       mount.MountID,
+		"hostname": mount.Hostname,
+	}
+
+	optional := map[string]string{
+		"container":     mount.ContainerName,
+		"containerId":   mount.ContainerID,
+		"service":       mount.ServiceName,
+		"task":          mount.TaskName,
+		"mountedAt":     mount.MountedAt,
+		"heartbeat":     mount.Heartbeat,
+		"pluginVersion": mount.PluginVersion,
+		"bootId":        mount.BootID,
+	}
+	for key, value := range optional {
+		if value != "" {
+			status[key] = value
+		}
+	}
+
+	if mount.Epoch > 0 {
+		status["epoch"] = mount.Epoch
+	}
+	if mount.ReadOnly {
+		status["readOnly"] = true
+	}
+	if len(mount.MountIDs) > 0 {
+		status["mountIds"] = mount.MountIDs
+	}
+
+	return status
+}
@@ -0,0 +1,66 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+
+	dockerVolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestMountRecordsTheContainer(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	// Docker mounts the volume before it starts the task
+	fake.addContainer("c1", "created", "data")
+	fake.setLabel("c1", swarmServiceLabel, "web")
+	fake.setLabel("c1", swarmTaskLabel, "web.1.abc")
+	fake.addContainer("c2", "exited", "data")
+
+	if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mount, err := volume.findMount("m1")
+	if err != nil || mount == nil {
+		t.Fatalf("Mount was not recorded: %v", err)
+	}
+	if mount.Schema != mountRecordSchema || mount.MountedAt == "" || mount.PluginVersion != version || mount.VolumeUUID != volume.UUID {
+		t.Errorf("Mount record %+v is incomplete", mount)
+	}
+	if mount.ContainerID != "c1" || mount.ContainerName != "c1" || mount.ServiceName != "web" || mount.TaskName != "web.1.abc" {
+		t.Errorf("Mount record %+v does not describe container c1", mount)
+	}
+}
+
+func TestMountOfAnUnknownContainer(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	driver := newTestDriver()
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	driver.addVolume(volume)
+
+	// Either container could be the one the mount is for
+	fake.addContainer("c1", "created", "data")
+	fake.addContainer("c2", "created", "data")
+
+	if _, err := driver.Mount(&dockerVolume.MountRequest{Name: "data", ID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mount, err := volume.findMount("m1")
+	if err != nil || mount == nil {
+		t.Fatalf("Mount was not recorded: %v", err)
+	}
+	if mount.ContainerID != "" {
+		t.Errorf("Mount was recorded for container %s, guessing between two", mount.ContainerID)
+	}
+}
@@ -0,0 +1,62 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Bind mounts the data directory read-only for a reader
+func (volume *sharedVolume) bindReadOnly(id string) error {
+	target := volume.GetReaderDir(id)
+
+	if err := fsMkdirAll(target, 0750); err != nil {
+		return err
+	}
+
+	err := fsMount(volume.GetDataDir(), target, syscall.MS_BIND)
+	if err != nil {
+		fsRemove(target)
+		return err
+	}
+
+	// A bind mount only becomes read-only when remounted
+	err = fsMount("", target, syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY)
+	if err != nil {
+		fsUnmount(target, 0)
+		fsRemove(target)
+		return err
+	}
+
+	return nil
+}
+
+// Removes the read-only bind mount of a reader
+func (volume *sharedVolume) unbindReadOnly(id string) error {
+	target := volume.GetReaderDir(id)
+
+	if err := fsUnmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return err
+	}
+
+	if err := fsRemove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func fsMount(source string, target string, flags uintptr) error {
+	_, err := filesystem.call("mount", target, func() (interface{}, error) {
+		return nil, syscall.Mount(source, target, "", flags, "")
+	})
+	return err
+}
+
+func fsUnmount(target string, flags int) error {
+	_, err := filesystem.call("unmount", target, func() (interface{}, error) {
+		return nil, syscall.Unmount(target, flags)
+	})
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Container states in which a container has certainly been through Mount
+var mountedContainerStates = map[string]bool{
+	"running":    true,
+	"paused":     true,
+	"restarting": true,
+}
+
+// Reconciles the mounts periodically. Restoring a mount may wait for the volume,
+// so it runs apart from the maintenance.
+func (driver sharedVolumeDriver) ReconcileRoutine() {
+	defer driver.routines.Done()
+
+	if reconcileInterval <= 0 {
+		return
+	}
+
+	if engine == nil {
+		log.Warnf("Reconciliation needs access to the Docker Engine, it is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		driver.Reconcile()
+
+		select {
+		case <-ticker.C:
+		case <-driver.stop:
+			return
+		}
+	}
+}
+
+// Matches the mount files of this host with the containers that use the volumes,
+// as reported by the Docker Engine, one container at a time. Mounts of containers that are no longer
+// attached are released, and mounts of containers that lost their mount file are restored.
+func (driver sharedVolumeDriver) Reconcile() {
+	for _, volume := range driver.snapshot() {
+		if driver.stopping() {
+			return
+		}
+		driver.reconcileVolume(volume)
+	}
+}
+
+func (driver sharedVolumeDriver) reconcileVolume(volume *sharedVolume) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+
+	attached, err := driver.volumeContainers(volume)
+	if err != nil {
+		log.Warnf("Cannot reconcile volume %s: %s", volume.Name, err)
+		return
+	}
+
+	// The containers the mounts of this host were made for
+	recorded := make(map[string]bool)
+	unknown := false
+
+	for _, mount := range volume.getMounts() {
+		if mount.Hostname != *hostname || mount.owner().isPreviousIncarnation() {
+			continue
+		}
+
+		if !mount.isAttached(attached) {
+			log.Warnf("Reconcile: releasing mount %s of volume %s, its container is no longer attached", mount.MountID, volume.Name)
+			if err := volume.releaseMount(mount); err != nil {
+				log.Warnf("Failed to release mount %s of volume %s: %s", mount.MountID, volume.Name, err)
+			}
+			continue
+		}
+
+		if mount.ContainerID == "" || len(mount.MountIDs) > 1 {
+			unknown = true
+		}
+		recorded[mount.ContainerID] = true
+	}
+
+	// A mount that is not known to belong to a single container might be the one of any of them,
+	// and a single exclusive mount file covers all containers on the host
+	if unknown || (len(recorded) > 0 && (volume.Exclusive || volume.HostExclusive)) {
+		return
+	}
+
+	containers, err := engine.listContainers(map[string][]string{
+		"volume": {volume.Name},
+	}, true)
+	if err != nil {
+		log.Warnf("Cannot reconcile volume %s: %s", volume.Name, err)
+		return
+	}
+
+	for i, container := range containers {
+		if !mountedContainerStates[container.State] || recorded[container.ID] {
+			continue
+		}
+
+		// The read-only bind mount a reader used is unknown
+		if volume.Mode == volumeModeRWSingle {
+			log.Warnf("Reconcile: container %s uses volume %s without a mount file, it cannot be restored in rw-single mode", container.ID, volume.Name)
+			continue
+		}
+
+		// Docker's mount ID is unknown, so the container ID is used instead.
+		// The mount file is released once the container stops.
+		log.Warnf("Reconcile: restoring the mount of volume %s for container %s", volume.Name, container.ID)
+
+		var mount *volumeMount
+		if group := volume.Group; group != "" {
+			// The members are locked in the order of their names
+			volume.mutex.Unlock()
+			mount, err = driver.mountGroup(volume, group, container.ID)
+			volume.mutex.Lock()
+		} else {
+			mount, err = volume.mount(container.ID)
+		}
+
+		if err == nil {
+			volume.recordContainer(mount, &containers[i])
+		} else {
+			log.Errorf("Reconcile: container %s uses volume %s, but its mount cannot be restored: %s", container.ID, volume.Name, err)
+		}
+
+		if volume.Exclusive || volume.HostExclusive {
+			// A single mount file covers all containers on the host
+			return
+		}
+	}
+}
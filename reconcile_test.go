@@ -0,0 +1,125 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReconcileReleasesMountsOfStoppedContainers(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	container := fake.addContainer("c1", "running", "data")
+
+	mount, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume.recordContainer(mount, &container)
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+
+	driver.Reconcile()
+	if !exists(volume.getExclusiveMountFile()) {
+		t.Fatal("Mount of a running container was released")
+	}
+
+	// Docker never called unmount for the stopped container
+	fake.setState("c1", "exited")
+	driver.Reconcile()
+
+	if exists(volume.getExclusiveMountFile()) {
+		t.Fatal("Mount of a stopped container was not released")
+	}
+}
+
+func TestReconcileRestoresMountsOfRunningContainers(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+	fake.addContainer("c1", "running", "data")
+	fake.addContainer("c2", "exited", "data")
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+
+	driver.Reconcile()
+
+	mount, err := volume.loadMountFile(volume.getExclusiveMountFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mount == nil {
+		t.Fatal("Mount of a running container was not restored")
+	}
+	if mount.MountID != "c1" || mount.ContainerID != "c1" {
+		t.Errorf("Mount was restored as %s for container %s", mount.MountID, mount.ContainerID)
+	}
+	if mount.Epoch == 0 {
+		t.Error("Restored exclusive mount has no fencing token")
+	}
+}
+
+func TestReconcileKeepsMountsOfOtherHosts(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// No container on h2 uses the volume
+	setTestHost(t, "h2")
+	fake.addContainer("c2", "exited", "data")
+	other := attachTestVolume(t, "data")
+
+	driver := newTestDriver()
+	driver.addVolume(other)
+	driver.Reconcile()
+
+	if !exists(other.getSharedMountFile("c1")) {
+		t.Fatal("Mount of another host was released")
+	}
+}
+
+func TestReconcileMatchesMountsPerContainer(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+	fake, stop := startFakeEngine(t)
+	defer stop()
+
+	volume := createTestVolume(t, "data", volumeMetadata{})
+	for _, id := range []string{"c1", "c2"} {
+		container := fake.addContainer(id, "running", "data")
+		mount, err := mountTestVolume(volume, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volume.recordContainer(mount, &container)
+	}
+
+	// Docker never called unmount for c2, and c3 lost its mount file
+	fake.setState("c2", "exited")
+	fake.addContainer("c3", "running", "data")
+
+	driver := newTestDriver()
+	driver.addVolume(volume)
+	driver.Reconcile()
+
+	if !exists(volume.getSharedMountFile("c1")) {
+		t.Error("Mount of a running container was released")
+	}
+	if exists(volume.getSharedMountFile("c2")) {
+		t.Error("Mount of a stopped container was kept while another container uses the volume")
+	}
+	if !exists(volume.getSharedMountFile("c3")) {
+		t.Error("Mount of a running container was not restored while another container has one")
+	}
+}
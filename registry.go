@@ -0,0 +1,72 @@
+package main
+
+// The bookkeeping of the driver maps volume names to volumes.
+// The map is guarded by the driver mutex, which is only held while the map is read or changed.
+// Everything else done with a volume is guarded by the mutex of the volume itself,
+// so a slow volume does not hold up the others.
+
+// Returns the volume from the bookkeeping
+func (driver sharedVolumeDriver) getVolume(name string) (*sharedVolume, bool) {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+
+	volume, ok := driver.volumes[name]
+	return volume, ok
+}
+
+// Returns the volumes in the bookkeeping at the time of the call
+func (driver sharedVolumeDriver) snapshot() []*sharedVolume {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+
+	volumes := make([]*sharedVolume, 0, len(driver.volumes))
+	for _, volume := range driver.volumes {
+		volumes = append(volumes, volume)
+	}
+
+	return volumes
+}
+
+// Adds the volume to the bookkeeping, unless a volume with the same name
+// was added in the meantime. Returns the volume in the bookkeeping.
+func (driver sharedVolumeDriver) addVolume(volume *sharedVolume) *sharedVolume {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if registered, ok := driver.volumes[volume.Name]; ok {
+		return registered
+	}
+
+	volume.stop = driver.stop
+	driver.volumes[volume.Name] = volume
+	return volume
+}
+
+// Replaces a volume in the bookkeeping, unless it was removed or replaced in the meantime.
+// Returns whether the volume was replaced.
+func (driver sharedVolumeDriver) replaceVolume(old *sharedVolume, volume *sharedVolume) bool {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if driver.volumes[old.Name] != old {
+		return false
+	}
+
+	volume.stop = driver.stop
+	driver.volumes[volume.Name] = volume
+	return true
+}
+
+// Removes a volume from the bookkeeping, unless it was replaced in the meantime.
+// Returns whether the volume was removed.
+func (driver sharedVolumeDriver) removeVolume(volume *sharedVolume) bool {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if driver.volumes[volume.Name] != volume {
+		return false
+	}
+
+	delete(driver.volumes, volume.Name)
+	return true
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// On NFS and beegfs a hung server blocks filesystem calls forever.
+// Calls on the shared root therefore run in a worker goroutine and are abandoned
+// when they do not finish within ioTimeout. A worker that is abandoned keeps blocking
+// until the server answers, but the caller and the locks it holds are freed.
+// After ioDegradeAfter timeouts in a row the root is marked degraded, and calls
+// fail immediately until the maintenance routine can reach the root again.
+
+var filesystem = newSharedFilesystem()
+
+type ioTimeoutError struct {
+	op      string
+	path    string
+	timeout time.Duration
+}
+
+func (err *ioTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %s on %s of %s", err.timeout, err.op, err.path)
+}
+
+type filesystemDegradedError struct {
+	since time.Time
+}
+
+func (err *filesystemDegradedError) Error() string {
+	return fmt.Sprintf("The shared filesystem is not responding since %s", err.since.Format(time.RFC3339))
+}
+
+type ioResult struct {
+	value interface{}
+	err   error
+}
+
+type sharedFilesystem struct {
+	mutex    *sync.Mutex
+	timeouts int
+	degraded *filesystemDegradedError
+	hung     int
+}
+
+func newSharedFilesystem() *sharedFilesystem {
+	return &sharedFilesystem{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Returns an error while the root is degraded
+func (fs *sharedFilesystem) check() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.degraded != nil {
+		return fs.degraded
+	}
+	return nil
+}
+
+// Runs the operation in a worker and waits for it at most ioTimeout.
+// The result is handed over by the worker, so an abandoned worker
+// never writes into the variables of its caller.
+func (fs *sharedFilesystem) call(op string, path string, operation func() (interface{}, error)) (interface{}, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+	return fs.run(op, path, ioTimeout, true, operation)
+}
+
+// Runs an operation that may take long, like removing a whole volume, with its own timeout.
+// Its timeouts say nothing about the health of the root, so they are not counted.
+func (fs *sharedFilesystem) callLong(op string, path string, timeout time.Duration, operation func() (interface{}, error)) (interface{}, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+	return fs.run(op, path, timeout, false, operation)
+}
+
+func (fs *sharedFilesystem) run(op string, path string, timeout time.Duration, counted bool, operation func() (interface{}, error)) (interface{}, error) {
+	if timeout <= 0 {
+		return operation()
+	}
+
+	done := make(chan ioResult)
+	abandoned := make(chan struct{})
+
+	go func() {
+		value, err := operation()
+
+		select {
+		case done <- ioResult{value: value, err: err}:
+		case <-abandoned:
+			// Nobody knows of a file opened too late, like one holding a flock
+			if file, ok := value.(io.Closer); ok && err == nil {
+				file.Close()
+			}
+			fs.finished(op, path)
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		if counted {
+			fs.succeeded()
+		}
+		return result.value, result.err
+	case <-timer.C:
+		fs.timedOut(op, path, timeout, counted)
+		close(abandoned)
+		return nil, &ioTimeoutError{op: op, path: path, timeout: timeout}
+	}
+}
+
+func (fs *sharedFilesystem) succeeded() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.timeouts = 0
+}
+
+func (fs *sharedFilesystem) timedOut(op string, path string, timeout time.Duration, counted bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.hung++
+
+	if !counted {
+		log.Warnf("Timed out after %s on %s of %s", timeout, op, path)
+		return
+	}
+
+	fs.timeouts++
+
+	log.Warnf("Timed out after %s on %s of %s (%d in a row)", timeout, op, path, fs.timeouts)
+
+	if fs.degraded == nil && ioDegradeAfter > 0 && fs.timeouts >= ioDegradeAfter {
+		fs.degraded = &filesystemDegradedError{since: time.Now()}
+		log.Errorf("The shared filesystem stopped responding, failing its calls until it is reachable again")
+	}
+}
+
+// Called when an abandoned worker returns at last
+func (fs *sharedFilesystem) finished(op string, path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.hung--
+
+	log.Infof("Abandoned %s of %s returned, %d still blocked", op, path, fs.hung)
+}
+
+// Checks whether the root responds again, and leaves the degraded mode if it does.
+// Returns whether the root is usable.
+func (fs *sharedFilesystem) probe(root string) bool {
+	if fs.check() == nil {
+		return true
+	}
+
+	_, err := fs.run("stat", root, ioTimeout, true, func() (interface{}, error) {
+		return os.Stat(root)
+	})
+	if err != nil {
+		log.Debugf("The shared filesystem is still not responding: %s", err)
+		return false
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	log.Infof("The shared filesystem is responding again after %s", time.Since(fs.degraded.since).Round(time.Second))
+	fs.degraded = nil
+	return true
+}
+
+// Describes the state of the root for the volume status
+func (fs *sharedFilesystem) status() string {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.degraded != nil {
+		return fmt.Sprintf("degraded since %s, %d calls blocked", fs.degraded.since.Format(time.RFC3339), fs.hung)
+	}
+	if fs.hung > 0 {
+		return fmt.Sprintf("%d calls blocked", fs.hung)
+	}
+	return ""
+}
+
+func fsStat(path string) (os.FileInfo, error) {
+	info, err := filesystem.call("stat", path, func() (interface{}, error) {
+		return os.Stat(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info.(os.FileInfo), nil
+}
+
+func fsLstat(path string) (os.FileInfo, error) {
+	info, err := filesystem.call("lstat", path, func() (interface{}, error) {
+		return os.Lstat(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info.(os.FileInfo), nil
+}
+
+func fsMkdir(path string, perm os.FileMode) error {
+	_, err := filesystem.call("mkdir", path, func() (interface{}, error) {
+		return nil, os.Mkdir(path, perm)
+	})
+	return err
+}
+
+func fsMkdirAll(path string, perm os.FileMode) error {
+	_, err := filesystem.call("mkdir", path, func() (interface{}, error) {
+		return nil, os.MkdirAll(path, perm)
+	})
+	return err
+}
+
+func fsRemove(path string) error {
+	_, err := filesystem.call("remove", path, func() (interface{}, error) {
+		return nil, os.Remove(path)
+	})
+	return err
+}
+
+// Removes a whole tree, which may take much longer than other calls
+func fsRemoveAll(path string) error {
+	_, err := filesystem.callLong("remove", path, removeTimeout, func() (interface{}, error) {
+		return nil, os.RemoveAll(path)
+	})
+	return err
+}
+
+func fsRename(oldPath string, newPath string) error {
+	_, err := filesystem.call("rename", oldPath, func() (interface{}, error) {
+		return nil, os.Rename(oldPath, newPath)
+	})
+	return err
+}
+
+func fsReadDir(path string) ([]os.FileInfo, error) {
+	files, err := filesystem.call("readdir", path, func() (interface{}, error) {
+		return ioutil.ReadDir(path)
+	})
+	if files == nil {
+		return nil, err
+	}
+	return files.([]os.FileInfo), err
+}
+
+func fsReadFile(path string) ([]byte, error) {
+	content, err := filesystem.call("read", path, func() (interface{}, error) {
+		return ioutil.ReadFile(path)
+	})
+	if content == nil {
+		return nil, err
+	}
+	return content.([]byte), err
+}
+
+// Writes the file, truncating it if it exists
+func fsWriteFile(path string, content []byte, perm os.FileMode) error {
+	_, err := filesystem.call("write", path, func() (interface{}, error) {
+		return nil, writeFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, content, perm)
+	})
+	return err
+}
+
+// Writes the file only if it does not exist yet
+func fsCreateFile(path string, content []byte, perm os.FileMode) error {
+	_, err := filesystem.call("create", path, func() (interface{}, error) {
+		return nil, writeFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, content, perm)
+	})
+	return err
+}
+
+// Replaces the content of an existing file.
+// The content is written to a temporary file first and renamed over the file,
+// so other nodes never observe a partially written file.
+func fsReplaceFile(path string, content []byte) error {
+	tempFile := fmt.Sprintf("%s.%s.tmp", path, *hostname)
+
+	if err := fsWriteFile(tempFile, content, 0600); err != nil {
+		fsRemove(tempFile)
+		return err
+	}
+
+	err := fsRename(tempFile, path)
+	if err != nil {
+		fsRemove(tempFile)
+	}
+
+	return err
+}
+
+func writeFile(path string, flag int, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return err
+	}
+
+	written, err := file.Write(content)
+	if err == nil && written < len(content) {
+		err = io.ErrShortWrite
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,42 @@
+// +build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLongCallTimeoutsDoNotDegrade(t *testing.T) {
+	defer func(timeout time.Duration, degradeAfter int) {
+		ioTimeout = timeout
+		ioDegradeAfter = degradeAfter
+		filesystem = newSharedFilesystem()
+	}(ioTimeout, ioDegradeAfter)
+
+	ioTimeout = 10 * time.Millisecond
+	ioDegradeAfter = 1
+	filesystem = newSharedFilesystem()
+
+	// Stands in for a server that does not answer
+	hung := make(chan struct{})
+	defer close(hung)
+	block := func() (interface{}, error) {
+		<-hung
+		return nil, nil
+	}
+
+	if _, err := filesystem.callLong("remove", "data", 10*time.Millisecond, block); err == nil {
+		t.Fatal("Long call did not time out")
+	}
+	if err := filesystem.check(); err != nil {
+		t.Fatalf("Timeout of a long call degraded the filesystem: %s", err)
+	}
+
+	if _, err := filesystem.call("stat", "data", block); err == nil {
+		t.Fatal("Call did not time out")
+	}
+	if err := filesystem.check(); err == nil {
+		t.Fatal("Timeout of a call did not degrade the filesystem")
+	}
+}
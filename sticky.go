@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a sticky volume stays bound to an owner that is gone
+const defaultStickyTimeout = 24 * time.Hour
+
+// Operators create this file in the locks directory to release a sticky volume
+const stickyReleaseFile = "owner.release"
+
+// Held by the host changing the owner or the fencing token, so hosts change meta.json one at a time
+const stickyClaimFile = "owner.claim"
+
+// How often a host waiting for the claim file tries again
+const claimRetryInterval = 50 * time.Millisecond
+
+func (volume *sharedVolume) GetStickyReleaseFile() string {
+	return filepath.Join(volume.GetLocksDir(), stickyReleaseFile)
+}
+
+func (volume *sharedVolume) GetStickyClaimFile() string {
+	return filepath.Join(volume.GetLocksDir(), stickyClaimFile)
+}
+
+// The time after which the ownership of a host that is gone expires
+func (volume *sharedVolume) stickyTimeout() time.Duration {
+	if volume.StickyTimeout > 0 {
+		return time.Duration(volume.StickyTimeout) * time.Second
+	}
+	return defaultStickyTimeout
+}
+
+// The time the owner was last known to be using the volume
+func (volume *sharedVolume) ownerSeen() time.Time {
+	seen, err := time.Parse(time.RFC3339, volume.OwnerSeen)
+	if err != nil {
+		return time.Time{}
+	}
+	return seen
+}
+
+// Returns an error if the sticky volume is owned by another host.
+// The ownership is dropped if it was released by an operator,
+// or the owner is gone for longer than the sticky timeout.
+func (volume *sharedVolume) checkOwner(host string) error {
+	if !volume.Sticky || volume.Owner == "" || volume.Owner == host {
+		return nil
+	}
+
+	if _, err := fsStat(volume.GetStickyReleaseFile()); err == nil {
+		log.Infof("Volume %s was released from owner %s", volume.Name, volume.Owner)
+		return volume.dropOwner()
+	}
+
+	if locking.isAlive(volume, volume.Owner) {
+		return fmt.Errorf("Volume %s is owned by host %s", volume.Name, volume.Owner)
+	}
+
+	if idle := time.Since(volume.ownerSeen()); idle < volume.stickyTimeout() {
+		return fmt.Errorf("Volume %s is owned by host %s, which was last seen %s ago", volume.Name, volume.Owner, idle.Truncate(time.Second))
+	}
+
+	log.Warnf("Ownership of volume %s by host %s expired", volume.Name, volume.Owner)
+
+	return volume.dropOwner()
+}
+
+// Drops the ownership of the current owner.
+// Returns an error if another host claimed the volume in the meantime.
+func (volume *sharedVolume) dropOwner() error {
+	owner := volume.Owner
+
+	err := volume.changeOwner(func(metadata *volumeMetadata) {
+		if metadata.Owner == owner {
+			metadata.Owner = ""
+			metadata.OwnerSeen = ""
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if volume.Owner != "" && volume.Owner != *hostname {
+		return fmt.Errorf("Volume %s is owned by host %s", volume.Name, volume.Owner)
+	}
+
+	fsRemove(volume.GetStickyReleaseFile())
+
+	return nil
+}
+
+// Records this host as the owner of a sticky volume that has no owner yet.
+// It is claimed before the volume is mounted, so two hosts cannot both pass the owner check.
+// Returns true if the volume was claimed by this call, and an error if another host owns it.
+func (volume *sharedVolume) claimOwner() (bool, error) {
+	if !volume.Sticky {
+		return false, nil
+	}
+
+	claimed := false
+	err := volume.changeOwner(func(metadata *volumeMetadata) {
+		// Another host may have claimed the volume in the meantime
+		if metadata.Owner == "" {
+			metadata.Owner = *hostname
+			claimed = true
+		}
+		if metadata.Owner == *hostname {
+			metadata.OwnerSeen = time.Now().Format(time.RFC3339)
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if volume.Owner != *hostname {
+		return false, fmt.Errorf("Volume %s is owned by host %s", volume.Name, volume.Owner)
+	}
+
+	if claimed {
+		log.Infof("Host %s is the owner of volume %s", *hostname, volume.Name)
+	}
+
+	return claimed, nil
+}
+
+// Gives up an ownership that was claimed for a mount that failed
+func (volume *sharedVolume) unclaimOwner() error {
+	return volume.changeOwner(func(metadata *volumeMetadata) {
+		if metadata.Owner == *hostname {
+			metadata.Owner = ""
+			metadata.OwnerSeen = ""
+		}
+	})
+}
+
+// Returns an error if the sticky volume is no longer owned by this host.
+// An operator may have released it, and another host claimed it, while it was being mounted.
+func (volume *sharedVolume) verifyOwner() error {
+	if !volume.Sticky {
+		return nil
+	}
+
+	if err := volume.loadMetadata(); err != nil {
+		return err
+	}
+
+	if volume.Owner != *hostname {
+		return fmt.Errorf("Volume %s was claimed by host %s while it was being mounted", volume.Name, volume.Owner)
+	}
+
+	return nil
+}
+
+// Changes the owner while holding the claim file
+func (volume *sharedVolume) changeOwner(change func(metadata *volumeMetadata)) error {
+	err := volume.takeClaim()
+	if os.IsExist(err) {
+		return fmt.Errorf("The owner of volume %s is being changed by another host", volume.Name)
+	} else if err != nil {
+		return err
+	}
+	defer volume.releaseClaim()
+
+	return volume.changeMetadata(change)
+}
+
+// Takes the claim file. Returns an error satisfying os.IsExist while another host holds it.
+// A claim file left behind by a host that crashed is removed after the lock timeout.
+func (volume *sharedVolume) takeClaim() error {
+	claimFile := volume.GetStickyClaimFile()
+
+	err := fsCreateFile(claimFile, []byte(*hostname), 0600)
+	if os.IsExist(err) {
+		if info, statErr := fsStat(claimFile); statErr == nil && time.Since(info.ModTime()) >= volume.lockTimeout() {
+			log.Warnf("Removing the abandoned owner claim of volume %s", volume.Name)
+			fsRemove(claimFile)
+			err = fsCreateFile(claimFile, []byte(*hostname), 0600)
+		}
+	}
+
+	return err
+}
+
+func (volume *sharedVolume) releaseClaim() {
+	fsRemove(volume.GetStickyClaimFile())
+}
+
+// Refreshes the time this host was last seen, if it owns the sticky volume.
+// The owner does so a few times within the sticky timeout.
+func (volume *sharedVolume) refreshOwner() error {
+	if !volume.Sticky {
+		return nil
+	}
+
+	if err := volume.loadMetadata(); err != nil {
+		return err
+	}
+
+	if volume.Owner == *hostname && time.Since(volume.ownerSeen()) >= volume.stickyTimeout()/10 {
+		return volume.touchOwner()
+	}
+
+	return nil
+}
+
+// The claim file is held, so a release or takeover that happened since meta.json
+// was loaded is not reverted
+func (volume *sharedVolume) touchOwner() error {
+	return volume.changeOwner(func(metadata *volumeMetadata) {
+		// The ownership may have been dropped in the meantime
+		if metadata.Owner == *hostname {
+			metadata.OwnerSeen = time.Now().Format(time.RFC3339)
+		}
+	})
+}
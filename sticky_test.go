@@ -0,0 +1,204 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStickyOwnerTakeover(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Sticky: true, StickyTimeout: 60})
+	if _, err := volume.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	if err := other.checkOwner("h2"); err == nil {
+		t.Fatal("Volume owned by a live host was taken over")
+	}
+
+	// h1 is gone, it was last seen longer than the sticky timeout ago
+	ageTestLock(t, volume, "h1", 2*lockTimeout, false)
+	if err := other.checkOwner("h2"); err == nil {
+		t.Fatal("Volume was taken over within the sticky timeout")
+	}
+	err := other.changeMetadata(func(metadata *volumeMetadata) {
+		metadata.OwnerSeen = time.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = other.checkOwner("h2"); err != nil {
+		t.Fatalf("Expired ownership was not dropped: %s", err)
+	}
+	if _, err = other.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = volume.loadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Owner != "h2" {
+		t.Errorf("Volume is owned by %s", volume.Owner)
+	}
+}
+
+func TestStickyClaimIsExclusive(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Sticky: true})
+
+	// h2 is in the middle of claiming the volume
+	claimFile := volume.GetStickyClaimFile()
+	if err := ioutil.WriteFile(claimFile, []byte("h2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := volume.claimOwner(); err == nil {
+		t.Fatal("Volume was claimed while another host was claiming it")
+	}
+	if volume.Owner != "" {
+		t.Fatalf("Volume is owned by %s", volume.Owner)
+	}
+
+	// h2 crashed while claiming it
+	abandoned := time.Now().Add(-2 * lockTimeout)
+	if err := os.Chtimes(claimFile, abandoned, abandoned); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := volume.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Owner != "h1" {
+		t.Errorf("Volume is owned by %q", volume.Owner)
+	}
+	if exists(claimFile) {
+		t.Error("Claim file was left behind")
+	}
+}
+
+func TestStickyDropKeepsANewOwner(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Sticky: true, Owner: "h3"})
+
+	// h2 dropped the expired owner and claimed the volume since h1 read it
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	if err := other.dropOwner(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	if err := volume.dropOwner(); err == nil {
+		t.Fatal("Ownership of the new owner was dropped")
+	}
+
+	if err := volume.loadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Owner != "h2" {
+		t.Errorf("Volume is owned by %q", volume.Owner)
+	}
+}
+
+func TestStickyClaimFailsForOwnedVolume(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	// h1 passed the owner check before h2 claimed the volume
+	volume := createTestVolume(t, "data", volumeMetadata{Sticky: true})
+	if err := volume.checkOwner("h1"); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	if _, err := other.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	if _, err := volume.claimOwner(); err == nil {
+		t.Fatal("Volume owned by h2 was claimed by h1")
+	}
+	if err := volume.verifyOwner(); err == nil {
+		t.Fatal("Volume owned by h2 was verified for h1")
+	}
+}
+
+func TestStickyRefreshKeepsATakeover(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Sticky: true})
+	if _, err := volume.claimOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	// h2 took the volume over after h1 loaded meta.json
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	err := other.changeOwner(func(metadata *volumeMetadata) {
+		metadata.Owner = "h2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	if err = volume.touchOwner(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = other.loadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if other.Owner != "h2" {
+		t.Errorf("Volume is owned by %q", other.Owner)
+	}
+}
+
+func TestFencingTokenWaitsForTheOwnerClaim(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	wait := false
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Sticky: true, Wait: &wait})
+
+	// h2 is changing the owner
+	if err := ioutil.WriteFile(volume.GetStickyClaimFile(), []byte("h2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.Remove(volume.GetStickyClaimFile())
+	}()
+
+	started := time.Now()
+	mount, err := mountTestVolume(volume, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) < 200*time.Millisecond {
+		t.Error("Fencing token was published while another host held the owner claim")
+	}
+
+	if err = volume.loadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Epoch != mount.Epoch {
+		t.Errorf("Fencing token %d was recorded instead of %d", volume.Epoch, mount.Epoch)
+	}
+	if exists(volume.GetStickyClaimFile()) {
+		t.Error("Owner claim was not released")
+	}
+}
@@ -5,31 +5,95 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+
 	dockerVolume "github.com/docker/go-plugins-helpers/volume"
 )
 
+// A single reader-writer volume allows one writer and any number of read-only readers
+const volumeModeRWSingle = "rw-single"
+
 // A single volume instance
 type sharedVolume struct {
 	*dockerVolume.Volume
+	volumeMetadata
+
+	// Set once this instance has written its lock file
+	lockWritten bool
+
+	// Guards everything this host does with the volume.
+	// It is released while a mount waits for the volume, so the maintenance can go on.
+	mutex sync.Mutex
+
+	// Closed when the driver shuts down, a mount waiting for the volume gives up then
+	stop <-chan struct{}
+}
+
+// The options and state of a volume stored in meta.json
+type volumeMetadata struct {
+	// Tells apart volumes created with the same name
+	UUID      string `json:",omitempty"`
+	CreatedBy string `json:",omitempty"`
+
 	Protected bool
 	Exclusive bool
+	// Any number of mounts, but only on a single host at a time
+	HostExclusive bool   `json:",omitempty"`
+	Mode          string `json:",omitempty"`
+	MaxMounts     int    `json:",omitempty"`
+
+	AllowedHosts []string `json:",omitempty"`
+	DeniedHosts  []string `json:",omitempty"`
+
+	// Mount wait policy, timeouts and intervals are in seconds
+	Wait         *bool `json:",omitempty"`
+	MountTimeout int   `json:",omitempty"`
+	MountRetry   int   `json:",omitempty"`
+
+	// Overrides the lock timeout for this volume, in seconds
+	LockTimeout int `json:",omitempty"`
+
+	// Sticky volumes stay bound to their owner host, the timeout is in seconds
+	Sticky        bool   `json:",omitempty"`
+	StickyTimeout int    `json:",omitempty"`
+	Owner         string `json:",omitempty"`
+	OwnerSeen     string `json:",omitempty"`
+
+	// Members of a group are always held by the same host
+	Group string `json:",omitempty"`
+
+	Epoch uint64
 }
 
 func (volume *sharedVolume) GetDataDir() string {
 	return filepath.Join(volume.Mountpoint, "_data")
 }
 
+// The read-only bind mount of a reader
+func (volume *sharedVolume) GetReaderDir(id string) string {
+	return filepath.Join(volume.Mountpoint, "_readers", id)
+}
+
 func (volume *sharedVolume) GetLocksDir() string {
 	return filepath.Join(volume.Mountpoint, "_locks")
 }
 
+func (volume *sharedVolume) GetMetaFile() string {
+	return filepath.Join(volume.Mountpoint, "meta.json")
+}
+
+// The fencing token file is placed inside the data directory,
+// so containers can check whether they still own the volume
+func (volume *sharedVolume) GetFencingTokenFile() string {
+	return filepath.Join(volume.GetDataDir(), ".sharedfs-epoch")
+}
+
 func (volume *sharedVolume) GetLockFile() string {
 	return volume.GetLockFileFor(*hostname)
 }
@@ -38,7 +102,9 @@ func (volume *sharedVolume) GetLockFileFor(name string) string {
 	return filepath.Join(volume.Mountpoint, "_locks", fmt.Sprintf("%s.lock", name))
 }
 
-func (driver *sharedVolumeDriver) newVolume(name string, options map[string]string) *sharedVolume {
+// Creates the volume from the options of a create request.
+// Returns an error for options that would weaken the volume if they were ignored.
+func (driver *sharedVolumeDriver) newVolume(name string, options map[string]string) (*sharedVolume, error) {
 
 	// Get the absolute volume path
 	volumePath := filepath.Join(driver.root, name)
@@ -50,8 +116,10 @@ func (driver *sharedVolumeDriver) newVolume(name string, options map[string]stri
 			Mountpoint: volumePath,
 			CreatedAt:  time.Now().Format(time.RFC3339),
 		},
-		Protected: defaultProtected,
-		Exclusive: defaultExclusive,
+		volumeMetadata: volumeMetadata{
+			Protected: defaultProtected,
+			Exclusive: defaultExclusive,
+		},
 	}
 
 	// Parse 'protected' option
@@ -65,19 +133,161 @@ func (driver *sharedVolumeDriver) newVolume(name string, options map[string]stri
 	if optsExclusive, ok := options["exclusive"]; ok {
 		if exclusive, err := strconv.ParseBool(optsExclusive); err == nil {
 			volume.Exclusive = exclusive
+		} else if optsExclusive == "host" {
+			volume.Exclusive = false
+			volume.HostExclusive = true
 		}
 	}
 
-	return volume
+	// Parse 'max-mounts' option, a single mount is the same as exclusive
+	if optsMaxMounts, ok := options["max-mounts"]; ok {
+		if maxMounts, err := strconv.Atoi(optsMaxMounts); err == nil && maxMounts > 0 {
+			volume.Exclusive = maxMounts == 1
+			volume.HostExclusive = false
+			if maxMounts > 1 {
+				volume.MaxMounts = maxMounts
+			}
+		}
+	}
+
+	// Parse 'allowed-hosts' and 'denied-hosts' options.
+	// An allow list without valid patterns would allow every host.
+	var err error
+	if optsAllowed, ok := options["allowed-hosts"]; ok {
+		if volume.AllowedHosts, err = parseHostPatterns(optsAllowed); err != nil {
+			return nil, fmt.Errorf("Invalid allowed-hosts of volume %s: %s", name, err)
+		}
+	}
+	if optsDenied, ok := options["denied-hosts"]; ok {
+		if volume.DeniedHosts, err = parseHostPatterns(optsDenied); err != nil {
+			return nil, fmt.Errorf("Invalid denied-hosts of volume %s: %s", name, err)
+		}
+	}
+
+	// Parse 'wait', 'mount-timeout' and 'mount-retry' options
+	if optsWait, ok := options["wait"]; ok {
+		if wait, err := strconv.ParseBool(optsWait); err == nil {
+			volume.Wait = &wait
+		}
+	}
+	if optsTimeout, ok := options["mount-timeout"]; ok {
+		if timeout, err := strconv.Atoi(optsTimeout); err == nil && timeout > 0 {
+			volume.MountTimeout = timeout
+		}
+	}
+	if optsRetry, ok := options["mount-retry"]; ok {
+		if retry, err := strconv.Atoi(optsRetry); err == nil && retry > 0 {
+			volume.MountRetry = retry
+		}
+	}
+
+	// Parse 'lock-timeout' option
+	if optsLockTimeout, ok := options["lock-timeout"]; ok {
+		if timeout, err := strconv.Atoi(optsLockTimeout); err == nil && timeout > 0 {
+			volume.LockTimeout = timeout
+		}
+	}
+
+	// Parse 'sticky' and 'sticky-timeout' options
+	if optsSticky, ok := options["sticky"]; ok {
+		if sticky, err := strconv.ParseBool(optsSticky); err == nil {
+			volume.Sticky = sticky
+		}
+	}
+	if optsStickyTimeout, ok := options["sticky-timeout"]; ok {
+		if timeout, err := strconv.Atoi(optsStickyTimeout); err == nil && timeout > 0 {
+			volume.StickyTimeout = timeout
+		}
+	}
+
+	// Parse 'mode' option
+	if optsMode, ok := options["mode"]; ok {
+		if optsMode == volumeModeRWSingle {
+			volume.Mode = optsMode
+			volume.Exclusive = false
+			volume.HostExclusive = false
+			volume.MaxMounts = 0
+		}
+	}
+
+	// Parse 'group' option, the members of a group are exclusive to one host
+	if optsGroup, ok := options["group"]; ok {
+		if volumeNamePattern.MatchString(optsGroup) {
+			volume.Group = optsGroup
+			volume.Exclusive = false
+			volume.HostExclusive = true
+			volume.MaxMounts = 0
+			volume.Mode = ""
+		} else {
+			log.Warnf("Ignoring invalid group name %s", optsGroup)
+		}
+	}
+
+	return volume, nil
+}
+
+// Returns true if both are the same volume, and not one that was removed
+// and created again with the same name.
+// Volumes created by older versions have no UUID, those are told apart by their creation time.
+func (volume *sharedVolume) sameIdentity(other *sharedVolume) bool {
+	if volume.UUID != "" || other.UUID != "" {
+		return volume.UUID == other.UUID
+	}
+	return volume.CreatedAt == other.CreatedAt
+}
+
+// Returns true if a lock or mount record written for the given volume UUID belongs to this volume
+func (volume *sharedVolume) ownsRecord(uuid string) bool {
+	return uuid == "" || volume.UUID == "" || uuid == volume.UUID
+}
+
+// Returns an error if the volume on disk is not the one in the bookkeeping anymore
+func (volume *sharedVolume) verifyIdentity() error {
+	stored := &sharedVolume{
+		Volume: &dockerVolume.Volume{
+			Name:       volume.Name,
+			Mountpoint: volume.Mountpoint,
+		},
+	}
+
+	if err := stored.loadMetadata(); err != nil {
+		return err
+	}
+
+	if !volume.sameIdentity(stored) {
+		return fmt.Errorf("Volume %s was removed and created again by another node", volume.Name)
+	}
+
+	return nil
+}
+
+// Returns the options of the volume, leaving out the state that changes while it is used
+func (volume *sharedVolume) options() string {
+	options := volume.volumeMetadata
+	options.Epoch = 0
+	options.Owner = ""
+	options.OwnerSeen = ""
+
+	content, _ := json.Marshal(options)
+	return string(content)
+}
+
+// The time after which locks on the volume are considered stale.
+// It is stored in the metadata, so every node uses the same value.
+func (volume *sharedVolume) lockTimeout() time.Duration {
+	if volume.LockTimeout > 0 {
+		return time.Duration(volume.LockTimeout) * time.Second
+	}
+	return lockTimeout
 }
 
 // Creates the directory structure needed for the volume
 func (volume *sharedVolume) createDirectoryStructure() error {
 
-	fstat, err := os.Lstat(volume.Mountpoint)
+	fstat, err := fsLstat(volume.Mountpoint)
 
 	if os.IsNotExist(err) {
-		err = os.Mkdir(volume.Mountpoint, 0750)
+		err = fsMkdir(volume.Mountpoint, 0750)
 	}
 
 	if fstat != nil && !fstat.IsDir() {
@@ -86,15 +296,15 @@ func (volume *sharedVolume) createDirectoryStructure() error {
 
 	if err == nil {
 		dataDir := volume.GetDataDir()
-		if _, err = os.Lstat(dataDir); os.IsNotExist(err) {
-			err = os.Mkdir(dataDir, 750)
+		if _, err = fsLstat(dataDir); os.IsNotExist(err) {
+			err = fsMkdir(dataDir, 750)
 		}
 	}
 
 	if err == nil {
 		locksDir := volume.GetLocksDir()
-		if _, err = os.Lstat(locksDir); os.IsNotExist(err) {
-			err = os.Mkdir(locksDir, 750)
+		if _, err = fsLstat(locksDir); os.IsNotExist(err) {
+			err = fsMkdir(locksDir, 750)
 		}
 	}
 
@@ -105,55 +315,101 @@ func (volume *sharedVolume) createDirectoryStructure() error {
 	return nil
 }
 
-func (volume *sharedVolume) delete() error {
-	var err error
+// Removes the volume from the root, unless it is protected or other hosts still lock it.
+// Returns true if the volume is gone.
+func (volume *sharedVolume) delete() (bool, error) {
 
 	// Reload the metadata to make sure no-one changed it.
 	volume.loadMetadata()
 
 	if volume.Protected {
-		return nil
+		return false, nil
 	}
 
-	if _, err = os.Stat(volume.Mountpoint); os.IsNotExist(err) {
-		return nil
-	} else if locked, err := volume.isLocked(); !locked && err == nil {
-		err = os.RemoveAll(volume.Mountpoint)
+	if _, err := fsStat(volume.Mountpoint); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
 	}
 
-	return err
+	if locked, err := volume.isLocked(); locked || err != nil {
+		return false, err
+	}
+
+	if err := fsRemoveAll(volume.Mountpoint); err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 // Saves the volume metadata into a file
 func (volume *sharedVolume) saveMetadata() error {
-	var file *os.File
-	metaFile := filepath.Join(volume.Mountpoint, "meta.json")
+	metaFile := volume.GetMetaFile()
+
+	if volume.UUID == "" {
+		uuid, err := newUUID()
+		if err != nil {
+			return err
+		}
+		volume.UUID = uuid
+		volume.CreatedBy = *hostname
+	}
 
 	content, err := json.MarshalIndent(volume, "", "  ")
 	if err == nil {
 		// Creating a meta file only if it does not yet exist.
 		// This should stop concurrency issues when creating 2 volume with the same name and different options
-		if file, err = os.OpenFile(metaFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err == nil {
-			var count int
-			count, err = file.Write(content)
-			if count < len(content) {
-				err = io.ErrShortWrite
-			}
-			file.Close()
-		}
+		err = fsCreateFile(metaFile, content, 0600)
 	}
 
 	return err
 }
 
+// Overwrites the volume metadata of an existing volume
+func (volume *sharedVolume) updateMetadata() error {
+	content, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsReplaceFile(volume.GetMetaFile(), content)
+}
+
+// Applies a change to the stored volume metadata. meta.json is read again first,
+// so edits made to it since it was last loaded are not reverted.
+func (volume *sharedVolume) changeMetadata(change func(metadata *volumeMetadata)) error {
+	if err := volume.loadMetadata(); err != nil {
+		return err
+	}
+
+	change(&volume.volumeMetadata)
+
+	return volume.updateMetadata()
+}
+
 // Loads the volume metadata from a file
 func (volume *sharedVolume) loadMetadata() error {
 
-	metaFile := filepath.Join(volume.Mountpoint, "meta.json")
+	metaFile := volume.GetMetaFile()
 
-	content, err := ioutil.ReadFile(metaFile)
-	if err == nil {
-		err = json.Unmarshal([]byte(content), &volume)
+	content, err := fsReadFile(metaFile)
+	if err != nil {
+		return err
 	}
-	return err
+
+	// Options missing from the file must not keep their previous values
+	loaded := &sharedVolume{}
+	if err = json.Unmarshal([]byte(content), loaded); err != nil {
+		return err
+	}
+
+	// The name and mountpoint are never changed, calls that don't lock the volume read them.
+	// The root may be mounted at a different path on the node that wrote the file.
+	if loaded.Volume != nil && loaded.CreatedAt != volume.CreatedAt {
+		volume.CreatedAt = loaded.CreatedAt
+	}
+	volume.volumeMetadata = loaded.volumeMetadata
+
+	return nil
 }
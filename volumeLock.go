@@ -1,8 +1,7 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"time"
@@ -17,17 +16,48 @@ type volumeLock struct {
 	volume       *sharedVolume
 	lockFilename string
 	hostname     string
+	identity     *nodeIdentity
 	lockedTime   time.Time
+	modTime      time.Time
+	observedAge  time.Duration
+	released     bool
+}
+
+// The content of a lock file
+type lockRecord struct {
+	nodeIdentity
+	Timestamp  string
+	VolumeUUID string `json:",omitempty"`
+	// Set when the owner shut down without mounts on the volume
+	Released bool `json:",omitempty"`
+}
+
+// Parses the content of a lock file.
+// Older versions only wrote the timestamp, those have no identity.
+func parseLockRecord(contents []byte) (*lockRecord, error) {
+	record := &lockRecord{}
+
+	if err := json.Unmarshal(contents, record); err != nil {
+		if _, timeErr := time.Parse(time.RFC3339, string(contents)); timeErr != nil {
+			return nil, err
+		}
+		record.Timestamp = string(contents)
+	}
+
+	return record, nil
 }
 
 func (lock *volumeLock) age() time.Duration {
+	if leaseMode == leaseModeObserve {
+		return lock.observedAge
+	}
 	return time.Now().UTC().Sub(lock.lockedTime)
 }
 
 func (lock *volumeLock) tryUnlock() (bool, error) {
 
 	lockAge := lock.age()
-	if lockAge < lockTimeout {
+	if lockAge < lock.volume.lockTimeout() {
 		return false, nil
 	}
 
@@ -39,39 +69,26 @@ func (lock *volumeLock) tryUnlock() (bool, error) {
 }
 
 func (lock *volumeLock) remove() error {
-	return os.Remove(lock.lockFilename)
+	observer.forget(lock.lockFilename)
+	return fsRemove(lock.lockFilename)
 }
 
 // Returns true if any node has locked the volume
 func (volume *sharedVolume) isLocked() (bool, error) {
-	locksDir := volume.GetLocksDir()
-
-	files, err := ioutil.ReadDir(locksDir)
-	if err != nil {
-		return false, err
-	}
-
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".lock" {
-			// We are only interested if such a file exists
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return locking.isLocked(volume)
 }
 
 func (volume *sharedVolume) hasLockfile() bool {
 	lockFile := volume.GetLockFile()
 
-	file, err := os.Stat(lockFile)
+	file, err := fsStat(lockFile)
 	return err == nil && !file.IsDir()
 }
 
 func (volume *sharedVolume) getLocks() map[string]*volumeLock {
 	locksDir := volume.GetLocksDir()
 
-	files, err := ioutil.ReadDir(locksDir)
+	files, err := fsReadDir(locksDir)
 	if err != nil {
 		return nil
 	}
@@ -97,20 +114,45 @@ func (volume *sharedVolume) getLocks() map[string]*volumeLock {
 func (volume *sharedVolume) getLock(host string) (*volumeLock, error) {
 
 	lockFile := volume.GetLockFileFor(host)
-	if contents, err := ioutil.ReadFile(lockFile); err == nil {
+	if contents, err := fsReadFile(lockFile); err == nil {
 
-		lockTimestamp := string(contents)
-		if lockTime, err := time.Parse(time.RFC3339, lockTimestamp); err == nil {
+		fileInfo, err := fsStat(lockFile)
+		if err != nil {
+			return nil, err
+		}
 
-			lock := &volumeLock{
-				volume:       volume,
-				lockFilename: lockFile,
-				hostname:     host,
-				lockedTime:   lockTime,
-			}
-			return lock, nil
+		record, err := parseLockRecord(contents)
+		if err != nil {
+			return nil, err
+		}
+
+		lockTime, err := time.Parse(time.RFC3339, record.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		lock := &volumeLock{
+			volume:       volume,
+			lockFilename: lockFile,
+			hostname:     host,
+			lockedTime:   lockTime,
+			modTime:      fileInfo.ModTime(),
+			observedAge:  observer.observe(lockFile, string(contents), fileInfo.ModTime()),
+			released:     record.Released,
 		}
-		return nil, err
+
+		if record.Hostname != "" {
+			lock.identity = &record.nodeIdentity
+		}
+
+		// A node still holding a removed volume with the same name wrote it,
+		// it does not hold this one
+		if !volume.ownsRecord(record.VolumeUUID) {
+			log.Debugf("Lock of host %s on volume %s was written for another volume with the same name", host, volume.Name)
+			lock.released = true
+		}
+
+		return lock, nil
 
 	} else if os.IsNotExist(err) {
 		return nil, nil
@@ -121,34 +163,75 @@ func (volume *sharedVolume) getLock(host string) (*volumeLock, error) {
 
 // Locks the volume
 func (volume *sharedVolume) lock() error {
+	if err := volume.verifyIdentity(); err != nil {
+		return err
+	}
+	return locking.lock(volume)
+}
 
-	lockFilename := volume.GetLockFile()
+// Unlocks the volume
+func (volume *sharedVolume) unlock() error {
+	return locking.unlock(volume)
+}
+
+// Writes the identity of this driver and the current time into the lock file of this host.
+// If the file was overwritten by another instance since our last write,
+// it is still refreshed but an identityConflictError is returned.
+func (volume *sharedVolume) writeLockFile() error {
+	return volume.writeLockRecord(false)
+}
+
+// Marks the lock file of this host as released.
+// The volume stays locked into existence, but other hosts don't have to wait
+// for the lock to time out before taking over its mounts.
+func (volume *sharedVolume) releaseLockFile() error {
+	return volume.writeLockRecord(true)
+}
 
-	now := time.Now().UTC().Format(time.RFC3339)
+func (volume *sharedVolume) writeLockRecord(released bool) error {
 
-	file, err := os.OpenFile(lockFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err == nil {
+	lockFilename := volume.GetLockFile()
 
-		length, err := file.WriteString(now)
-		if err == nil && length != len(now) {
-			err = fmt.Errorf("Failed to write timestamp to lockfile")
+	var conflict error
+	if volume.lockWritten {
+		if contents, err := fsReadFile(lockFilename); err == nil {
+			if record, err := parseLockRecord(contents); err == nil && record.Nonce != self.Nonce {
+				conflict = &identityConflictError{
+					volume: volume.Name,
+					other:  record.nodeIdentity,
+				}
+			}
 		}
+	}
 
-		file.Close()
+	record := &lockRecord{
+		nodeIdentity: *self,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		VolumeUUID:   volume.UUID,
+		Released:     released,
+	}
 
+	content, err := json.Marshal(record)
+	if err != nil {
 		return err
+	}
 
+	if err = fsWriteFile(lockFilename, content, 0600); err != nil {
+		return err
 	}
 
-	return err
+	volume.lockWritten = true
+	saveNonce()
+
+	return conflict
 }
 
-// Unlocks the volume
-func (volume *sharedVolume) unlock() error {
+// Removes the lock file of this host
+func (volume *sharedVolume) removeLockFile() error {
 
 	lockFilename := volume.GetLockFile()
 
-	if err := os.Remove(lockFilename); err != nil && !os.IsNotExist(err) {
+	if err := fsRemove(lockFilename); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
@@ -4,24 +4,121 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// Keep track of who has mounted the volume
+// Keep track of who has mounted the volume.
+// Fields are only ever added to the record, so older drivers can still read it.
 type volumeMount struct {
 	LockFilePath string `json:"-"`
+	Schema       int    `json:",omitempty"`
 	MountID      string
 	Hostname     string
+	Epoch        uint64 `json:",omitempty"`
+	BootID       string `json:",omitempty"`
+	PID          int    `json:",omitempty"`
+	StartedAt    string `json:",omitempty"`
+	ReadOnly     bool   `json:",omitempty"`
+	// All mount IDs sharing a host exclusive mount
+	MountIDs []string `json:",omitempty"`
+	// Refreshed while a container on the host uses the mount
+	Heartbeat string `json:",omitempty"`
+
+	// Since schema 1
+	MountedAt     string `json:",omitempty"`
+	PluginVersion string `json:",omitempty"`
+	ContainerID   string `json:",omitempty"`
+	ContainerName string `json:",omitempty"`
+	ServiceName   string `json:",omitempty"`
+	TaskName      string `json:",omitempty"`
+
+	// Since schema 2
+	VolumeUUID string `json:",omitempty"`
+}
+
+// Returns true if the mount was made for the given id.
+// A host exclusive mount is held for the ids in MountIDs only.
+func (mount *volumeMount) hasMountID(id string) bool {
+	if len(mount.MountIDs) == 0 {
+		return mount.MountID == id
+	}
+
+	for _, mountID := range mount.MountIDs {
+		if mountID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The identity of the driver run that created the mount
+func (mount *volumeMount) owner() *nodeIdentity {
+	return &nodeIdentity{
+		Hostname:  mount.Hostname,
+		BootID:    mount.BootID,
+		PID:       mount.PID,
+		StartedAt: mount.StartedAt,
+	}
+}
+
+// Returned when the mount files stay taken by someone else
+type mountBusyError struct {
+	volume string
+	// Descriptions of the current holders
+	holders []string
+	// Set if the only holder is this host
+	sameHost bool
+	// Number of waiters that were queued ahead
+	ahead int
+}
+
+func (volume *sharedVolume) newMountBusyError(holders []*volumeMount, ahead int) *mountBusyError {
+	err := &mountBusyError{
+		volume:   volume.Name,
+		holders:  make([]string, 0, len(holders)),
+		sameHost: len(holders) == 1 && holders[0].Hostname == *hostname,
+		ahead:    ahead,
+	}
+
+	for _, holder := range holders {
+		lockAge := "unknown"
+		if lock, lockErr := volume.getLock(holder.Hostname); lockErr == nil && lock != nil {
+			lockAge = lock.age().Truncate(time.Second).String()
+		}
+
+		mountID := holder.MountID
+		if holder.ContainerName != "" {
+			mountID = fmt.Sprintf("%s of container %s", mountID, holder.ContainerName)
+		}
+
+		err.holders = append(err.holders, fmt.Sprintf("mount %s on host %s (lock age %s)", mountID, holder.Hostname, lockAge))
+	}
+
+	return err
+}
+
+func (err *mountBusyError) Error() string {
+	if err.sameHost {
+		return fmt.Sprintf("Volume %s is already mounted on the same host by %s", err.volume, err.holders[0])
+	}
+
+	if len(err.holders) == 0 {
+		return fmt.Sprintf("Volume %s is busy, %d mounts are waiting ahead", err.volume, err.ahead)
+	}
+
+	return fmt.Sprintf("Volume %s is busy, held by %s", err.volume, strings.Join(err.holders, ", "))
 }
 
 // Load the mount info from file
 func (mount *volumeMount) load() error {
-	content, err := ioutil.ReadFile(mount.LockFilePath)
+	content, err := fsReadFile(mount.LockFilePath)
 
 	if err == nil {
 		err = json.Unmarshal([]byte(content), mount)
@@ -38,48 +135,67 @@ func (mount *volumeMount) save() error {
 		return err
 	}
 
-	file, err := os.OpenFile(mount.LockFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return err
+	err = fsCreateFile(mount.LockFilePath, content, 0600)
+	if err == io.ErrShortWrite {
+		fsRemove(mount.LockFilePath)
 	}
+	return err
+}
 
-	written, err := file.Write(content)
-	file.Close()
-
-	if err == nil && written != len(content) {
-		os.Remove(mount.LockFilePath)
+// Replace the content of an existing mount file
+func (mount *volumeMount) overwrite() error {
 
-		err = io.ErrShortWrite
+	content, err := json.MarshalIndent(mount, "", "  ")
+	if err != nil {
+		return err
 	}
-	return err
+
+	return fsReplaceFile(mount.LockFilePath, content)
 }
 
 // Remove the mount lock file
 func (mount *volumeMount) remove() error {
 
-	if err := os.Remove(mount.LockFilePath); !os.IsNotExist(err) {
+	observer.forget(mount.LockFilePath)
+
+	if err := fsRemove(mount.LockFilePath); !os.IsNotExist(err) {
 		return err
 	}
 
 	return nil
 }
 
-func (volume *sharedVolume) getMountFile(id string) string {
-	var mountFile string
-	if volume.Exclusive {
-		mountFile = filepath.Join(volume.Mountpoint, "_locks", "exclusive.mount")
-	} else {
-		mountFile = filepath.Join(volume.Mountpoint, "_locks", fmt.Sprintf("%s.mount", id))
+// Returns the mount files a mount may take, in the order they are tried.
+// Exclusive volumes have a single slot, the exclusive mount file.
+func (volume *sharedVolume) getSlotFiles(id string) []string {
+	if volume.Exclusive || volume.HostExclusive {
+		return []string{volume.getExclusiveMountFile()}
+	}
+
+	if volume.MaxMounts > 0 {
+		slots := make([]string, volume.MaxMounts)
+		for slot := range slots {
+			slots[slot] = filepath.Join(volume.Mountpoint, "_locks", fmt.Sprintf("slot-%d.mount", slot))
+		}
+		return slots
 	}
 
-	return mountFile
+	return []string{volume.getSharedMountFile(id)}
+}
+
+func (volume *sharedVolume) getExclusiveMountFile() string {
+	return filepath.Join(volume.Mountpoint, "_locks", "exclusive.mount")
+}
+
+func (volume *sharedVolume) getSharedMountFile(id string) string {
+	return filepath.Join(volume.Mountpoint, "_locks", fmt.Sprintf("%s.mount", id))
 }
 
 // Returns true if any node has mounted the volume
 func (volume *sharedVolume) isMounted() (bool, error) {
 	locksDir := volume.GetLocksDir()
 
-	files, err := ioutil.ReadDir(locksDir)
+	files, err := fsReadDir(locksDir)
 	if err != nil {
 		return false, err
 	}
@@ -97,7 +213,7 @@ func (volume *sharedVolume) isMounted() (bool, error) {
 func (volume *sharedVolume) getMounts() map[string]*volumeMount {
 	locksDir := volume.GetLocksDir()
 
-	files, err := ioutil.ReadDir(locksDir)
+	files, err := fsReadDir(locksDir)
 	if err != nil {
 		return nil
 	}
@@ -110,9 +226,12 @@ func (volume *sharedVolume) getMounts() map[string]*volumeMount {
 
 			mountID := fileName[0 : len(fileName)-len(".mount")]
 
-			if mount, err := volume.loadMount(mountID); err == nil {
+			if mount, err := volume.loadMountFile(filepath.Join(locksDir, fileName)); err == nil {
 
-				mounts[mountID] = mount
+				// The file may have been removed in the meantime
+				if mount != nil {
+					mounts[mountID] = mount
+				}
 			} else {
 				log.Errorf("Failed to read mount file for %s", mountID)
 			}
@@ -122,23 +241,68 @@ func (volume *sharedVolume) getMounts() map[string]*volumeMount {
 	return mounts
 }
 
-// LoadFrom a file
+// Returns the mount ID of the writer and of the readers of a single reader-writer volume
+func (volume *sharedVolume) getWriterAndReaders() (string, []string) {
+	writer := ""
+	readers := []string{}
+
+	for _, mount := range volume.getMounts() {
+		if mount.ReadOnly {
+			readers = append(readers, mount.MountID)
+		} else {
+			writer = mount.MountID
+		}
+	}
+
+	return writer, readers
+}
+
+// Creates the mount info for this host
 func (volume *sharedVolume) newMount(id string) *volumeMount {
+	now := time.Now().UTC().Format(time.RFC3339)
 
 	mount := &volumeMount{
-		LockFilePath: volume.getMountFile(id),
-		MountID:      id,
-		Hostname:     *hostname,
+		Schema:        mountRecordSchema,
+		MountID:       id,
+		Hostname:      *hostname,
+		BootID:        self.BootID,
+		PID:           self.PID,
+		StartedAt:     self.StartedAt,
+		Heartbeat:     now,
+		MountedAt:     now,
+		PluginVersion: self.Version,
+		VolumeUUID:    volume.UUID,
 	}
 
 	return mount
 }
 
-// LoadFrom a file
-func (volume *sharedVolume) loadMount(id string) (*volumeMount, error) {
+// Finds the mount of the given id, wherever it is stored
+func (volume *sharedVolume) findMount(id string) (*volumeMount, error) {
+	mountFiles := volume.getSlotFiles(id)
+
+	if volume.Mode == volumeModeRWSingle {
+		mountFiles = []string{volume.getExclusiveMountFile(), volume.getSharedMountFile(id)}
+	}
+
+	for _, mountFile := range mountFiles {
+		mount, err := volume.loadMountFile(mountFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if mount != nil && mount.hasMountID(id) {
+			return mount, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (volume *sharedVolume) loadMountFile(mountFile string) (*volumeMount, error) {
 
 	mount := &volumeMount{
-		LockFilePath: volume.getMountFile(id),
+		LockFilePath: mountFile,
 	}
 
 	if err := mount.load(); err != nil {
@@ -151,106 +315,428 @@ func (volume *sharedVolume) loadMount(id string) (*volumeMount, error) {
 	return mount, nil
 }
 
-func (volume *sharedVolume) mount(id string) error {
-	var err error
-	newMount := volume.newMount(id)
+// Mounts the volume for the given id
+func (volume *sharedVolume) mount(id string) (*volumeMount, error) {
+	if volume.Mode == volumeModeRWSingle {
+		return volume.mountRWSingle(id)
+	}
 
-	if err = newMount.save(); err == nil {
-		// FastPath, mount acquired
-		return nil
+	if volume.HostExclusive {
+		return volume.mountHostExclusive(id)
+	}
+
+	return volume.acquireMount(volume.newMount(id), volume.getSlotFiles(id), volume.mountWaitTime())
+}
+
+// How long a mount waits for a busy volume
+func (volume *sharedVolume) mountWaitTime() time.Duration {
+	if volume.Wait != nil && !*volume.Wait {
+		return 0
+	}
+
+	if volume.MountTimeout > 0 {
+		return time.Duration(volume.MountTimeout) * time.Second
+	}
+
+	return volume.leaseWaitTime()
+}
+
+// The first delay between attempts to mount a busy volume
+func (volume *sharedVolume) mountRetryInterval() time.Duration {
+	if volume.MountRetry > 0 {
+		return time.Duration(volume.MountRetry) * time.Second
+	}
+
+	return defaultMountRetryInterval
+}
+
+// The first mount on a host takes the exclusive mount file,
+// further mounts on the same host are added to it.
+func (volume *sharedVolume) mountHostExclusive(id string) (*volumeMount, error) {
+	mount, _, err := volume.holdHostExclusive(id)
+	return mount, err
+}
+
+// Takes the exclusive mount file for this host, or adds the id to it if this host holds it already.
+// An empty id holds the mount for the group of the volume, without a mount of its own.
+// Returns true if the mount file was newly acquired.
+func (volume *sharedVolume) holdHostExclusive(id string) (*volumeMount, bool, error) {
+	if holder, err := volume.joinHostExclusive(id); err != nil || holder != nil {
+		return holder, false, err
+	}
+
+	var newMount *volumeMount
+	if id == "" {
+		newMount = volume.newMount(volume.getGroupMountID())
+	} else {
+		newMount = volume.newMount(id)
+		newMount.MountIDs = []string{id}
+	}
+
+	mount, err := volume.acquireMount(newMount, []string{volume.getExclusiveMountFile()}, volume.mountWaitTime())
+
+	// Another mount on this host took the mount file while this one was waiting
+	if busy, ok := err.(*mountBusyError); ok && busy.sameHost {
+		if holder, joinErr := volume.joinHostExclusive(id); joinErr != nil || holder != nil {
+			return holder, false, joinErr
+		}
+	}
+
+	return mount, err == nil, err
+}
+
+// Adds the id to the exclusive mount file if this host holds it.
+// Returns nil without an error if the mount file is not held by this host.
+func (volume *sharedVolume) joinHostExclusive(id string) (*volumeMount, error) {
+	holder, err := volume.loadMountFile(volume.getExclusiveMountFile())
+	if err != nil {
+		return nil, err
+	}
+
+	if holder == nil || holder.Hostname != *hostname || holder.owner().isPreviousIncarnation() {
+		return nil, nil
+	}
+
+	if id != "" && !holder.hasMountID(id) {
+		holder.MountIDs = append(holder.MountIDs, id)
+		if err = locking.update(holder); err != nil {
+			return nil, err
+		}
+	}
+
+	return holder, nil
+}
+
+// The first mount becomes the writer and takes the exclusive mount file.
+// While the writer slot is taken, every other mount becomes a read-only reader.
+func (volume *sharedVolume) mountRWSingle(id string) (*volumeMount, error) {
+
+	writer, err := volume.acquireMount(volume.newMount(id), []string{volume.getExclusiveMountFile()}, 0)
+	if err == nil {
+		return writer, nil
+	} else if _, ok := err.(*mountBusyError); !ok {
+		return nil, err
+	}
+
+	reader := volume.newMount(id)
+	reader.ReadOnly = true
+
+	if reader, err = volume.acquireMount(reader, []string{volume.getSharedMountFile(id)}, 0); err != nil {
+		return nil, err
+	}
+
+	if err = volume.bindReadOnly(id); err != nil {
+		locking.release(reader)
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Tries to acquire one of the slot files, waiting for their current holders to go away
+// for up to the given duration. Returns the mount holding the slot.
+// The caller holds the mutex of the volume, it is released while waiting.
+func (volume *sharedVolume) acquireMount(newMount *volumeMount, slotFiles []string, wait time.Duration) (*volumeMount, error) {
+
+	// Highest fencing token seen on a previous holder of the exclusive mount
+	var seenEpoch uint64
+
+	// FastPath, take the first free slot unless others are already waiting
+	if len(volume.getQueue()) == 0 {
+		for _, slotFile := range slotFiles {
+			if acquired, err := volume.tryAcquireSlot(newMount, slotFile, seenEpoch); err != nil {
+				return nil, err
+			} else if acquired {
+				return newMount, nil
+			}
+		}
 	}
 
 	// Failed to acquire mount, try slow path
 	// Let's investigate
-	var mount *volumeMount
-	var lock *volumeLock
+
+	// Get in line, so waiters are served in the order they arrived
+	var ticket *volumeMount
+	if wait > 0 {
+		var err error
+		if ticket, err = volume.enqueue(newMount); err != nil {
+			log.Warnf("Failed to queue for volume %s, waiting without a ticket: %s", volume.Name, err)
+		} else {
+			defer volume.retireTicket(ticket)
+		}
+	}
 
 	// The lock keepalive seems to be either late or the other node is dead.
 	// Worth to wait a little and see...
 
-	tryUntil := time.Now().Add(lockTimeout)
+	tryUntil := time.Now().Add(wait)
+	retry := newBackoff(volume.mountRetryInterval(), maxMountRetryInterval)
 
-	for time.Now().Before(tryUntil) {
-
-		time.Sleep(time.Second * 5)
+	// Asks the holder of an exclusive mount to give it up
+	var handover *handoverRequest
+	defer func() {
+		if handover != nil {
+			handover.remove()
+		}
+	}()
 
-		// Who has the mount:
-		mount, err = volume.loadMount(id)
-		if err != nil {
-			// We already own the mount by us...
-			return fmt.Errorf("Failed to load mount info for %s", volume.Name)
+	for {
+		// Shutdown waits for the mutex, the mount must not keep it waiting until its deadline
+		if volume.stopping() {
+			return nil, fmt.Errorf("Gave up mounting volume %s, the driver is shutting down", volume.Name)
 		}
 
-		// The mount file might be gone already
-		if mount != nil {
+		var holders []*volumeMount
 
-			if mount.MountID == id {
-				// The same ID already owns the mount.
-				// It shouldn't happen.
-				return nil
+		// Number of waiters that have to be served first.
+		// Mounts without a ticket, like those that don't wait, are behind all of them.
+		ahead := volume.queuePosition(ticket)
 
-			} else if mount.Hostname == *hostname {
-				// We already own the mount by us...
-				// And because it is us, there is little point in trying to wait for a timeout
-				return fmt.Errorf("Volume %s is already mounted on the same host", volume.Name)
-			}
+		for _, slotFile := range slotFiles {
 
-			// Check the host's lockfile and look for a timeout
-			lock, err = volume.getLock(mount.Hostname)
+			// Who has the mount:
+			mount, err := volume.loadMountFile(slotFile)
 			if err != nil {
-				log.Errorf("Failed to load lock file for volume %s", volume.Name)
-				continue
+				return nil, fmt.Errorf("Failed to load mount info for %s", volume.Name)
 			}
 
-			// If the file exist, did it time out already?
-			if lock != nil {
-				if ok, err := lock.tryUnlock(); err != nil {
-					// Something went wrong during remove
-					// This is not normal operation
-					return err
-				} else if ok {
-					// The lock file was timed out, so we have removed it
-					lock = nil
+			// A node still holding a removed volume with the same name wrote it
+			if mount != nil && !volume.ownsRecord(mount.VolumeUUID) {
+				log.Warnf("Removing mount %s on host %s, it was made on a removed volume named %s", mount.MountID, mount.Hostname, volume.Name)
+				if err = mount.remove(); err != nil {
+					return nil, err
 				}
+				mount = nil
 			}
 
-			// If the lock file does not exist, or was removed
-			if lock == nil {
-				// Try to remove the mount file
-				err = mount.remove()
-				if err != nil {
-					// The mount is not actually locked, something else is wrong here...
-					return err
+			// The mount file might be gone already
+			if mount != nil {
+
+				if mount.Epoch > seenEpoch {
+					seenEpoch = mount.Epoch
+				}
+
+				if mount.MountID == newMount.MountID {
+					// The same ID already owns the mount.
+					// It shouldn't happen.
+					return mount, nil
+
+				} else if mount.Hostname != *hostname {
+					// Take over the mount if its holder is gone
+					reclaimed, err := locking.reclaim(volume, mount)
+					if err != nil {
+						return nil, err
+					}
+
+					// Only the first in line asks for a handover
+					if !reclaimed && handover == nil && wait > 0 && ahead == 0 && len(slotFiles) == 1 {
+						if handover, err = volume.requestHandover(newMount); err != nil {
+							log.Warnf("Failed to request a handover of volume %s: %s", volume.Name, err)
+						}
+					}
+
+				} else if len(slotFiles) == 1 {
+					// We already own the mount by us...
+					// And because it is us, there is little point in trying to wait for a timeout
+					return nil, volume.newMountBusyError([]*volumeMount{mount}, 0)
 				}
 			}
+
+			if ahead < len(slotFiles) {
+				if acquired, err := volume.tryAcquireSlot(newMount, slotFile, seenEpoch); err != nil {
+					return nil, err
+				} else if acquired {
+					return newMount, nil
+				}
+			}
+
+			if mount != nil {
+				holders = append(holders, mount)
+			}
+		}
+
+		remaining := time.Until(tryUntil)
+		if remaining <= 0 {
+			return nil, volume.newMountBusyError(holders, ahead)
+		}
+
+		// Make the last attempt right at the deadline
+		delay := retry.delay()
+		if delay > remaining {
+			delay = remaining
+		}
+
+		// Let others use the volume while waiting, the caller holds its mutex
+		volume.mutex.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-volume.stop:
+		}
+		volume.mutex.Lock()
+	}
+}
+
+// Returns true once the driver that registered the volume is shutting down
+func (volume *sharedVolume) stopping() bool {
+	select {
+	case <-volume.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Tries to take a single slot file. Returns false without an error if it is taken.
+func (volume *sharedVolume) tryAcquireSlot(newMount *volumeMount, slotFile string, seenEpoch uint64) (bool, error) {
+	newMount.LockFilePath = slotFile
+
+	// The exclusive mount file carries a fencing token
+	newMount.Epoch = 0
+	if slotFile == volume.getExclusiveMountFile() {
+		newMount.Epoch = volume.nextEpoch(seenEpoch)
+	}
+
+	if err := locking.acquire(newMount); err != nil {
+		if os.IsExist(err) {
+			return false, nil
 		}
+		// If the error is not about the file existing, than return
+		return false, err
+	}
+
+	return true, volume.fence(newMount)
+}
+
+// Returns the fencing token for the next exclusive acquisition.
+// The token must be larger than anything recorded in the metadata
+// and anything seen on a previous holder, which might have been fenced
+// off before it could update the metadata.
+func (volume *sharedVolume) nextEpoch(seenEpoch uint64) uint64 {
+	if err := volume.loadMetadata(); err != nil {
+		log.Warnf("Failed to reload metadata for volume %s: %s", volume.Name, err)
+	}
+
+	epoch := volume.Epoch
+	if seenEpoch > epoch {
+		epoch = seenEpoch
+	}
+
+	return epoch + 1
+}
+
+// Publishes the fencing token of a freshly acquired exclusive mount
+// in the metadata and in the data directory.
+// If the token cannot be published the mount is given up.
+func (volume *sharedVolume) fence(mount *volumeMount) error {
+	if mount.Epoch == 0 {
+		return nil
+	}
+
+	err := volume.publishEpoch(mount.Epoch)
+	if err == nil {
+		token := strconv.FormatUint(mount.Epoch, 10)
+		err = fsWriteFile(volume.GetFencingTokenFile(), []byte(token), 0644)
+	}
+
+	if err != nil {
+		log.Errorf("Failed to publish fencing token %d for volume %s: %s", mount.Epoch, volume.Name, err)
+		locking.release(mount)
+		return err
+	}
+
+	log.Infof("Volume %s exclusively mounted with fencing token %d", volume.Name, mount.Epoch)
+
+	return nil
+}
 
-		if err = newMount.save(); !os.IsExist(err) {
-			// If the error is not about the file existing, than return
-			// This could also mean success BTW
+// Records the fencing token in the metadata while holding the claim file,
+// so a concurrent change of the sticky owner does not write back the previous token.
+// Others hold the claim only briefly, it is waited for well within the lock timeout.
+func (volume *sharedVolume) publishEpoch(epoch uint64) error {
+	tryUntil := time.Now().Add(volume.lockTimeout() / 2)
+	retry := newBackoff(claimRetryInterval, time.Second)
+
+	for {
+		err := volume.takeClaim()
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
 			return err
 		}
+
+		if time.Now().After(tryUntil) {
+			return fmt.Errorf("The metadata of volume %s is being changed by another host", volume.Name)
+		}
+		time.Sleep(retry.delay())
 	}
+	defer volume.releaseClaim()
 
-	return err
+	return volume.changeMetadata(func(metadata *volumeMetadata) {
+		metadata.Epoch = epoch
+	})
 }
 
 func (volume *sharedVolume) unmount(id string) error {
-	var err error
-	mount, err := volume.loadMount(id)
-	if os.IsNotExist(err) {
-		log.Warnf("Trying to unmount a volume that is not mounted")
-	} else if err != nil {
+	mount, err := volume.findMount(id)
+	if err != nil {
 		return err
 	}
 
-	if mount.MountID != id {
+	if mount == nil {
+		log.Warnf("Trying to unmount a volume that is not mounted")
+	} else if !mount.hasMountID(id) {
 		log.Errorf("Trying to unmount a volume that is mounted for a different id")
 	} else if mount.Hostname != *hostname {
 		log.Errorf("Trying to unmount a volume that is mounted for a different host")
+	} else if len(mount.MountIDs) > 1 {
+		// Other mounts on this host still use the host exclusive mount
+		err = volume.removeMountID(mount, id)
 	} else {
-		err = mount.remove()
+		err = volume.releaseMount(mount)
 	}
 
 	return err
 }
+
+// Removes the id from a host exclusive mount that stays held
+func (volume *sharedVolume) removeMountID(mount *volumeMount, id string) error {
+	mountIDs := []string{}
+	for _, mountID := range mount.MountIDs {
+		if mountID != id {
+			mountIDs = append(mountIDs, mountID)
+		}
+	}
+	mount.MountIDs = mountIDs
+
+	// The container recorded for the removed id is no longer known.
+	// A group keeps holding the mount without any id, it must not follow a stopped container.
+	if mount.MountID == id || mount.ContainerID == id || len(mountIDs) == 0 {
+		mount.describeContainer(&dockerContainer{})
+	}
+
+	// The mount is named after one of the ids still using it
+	if mount.MountID == id && len(mountIDs) > 0 {
+		mount.MountID = mountIDs[0]
+	}
+
+	return locking.update(mount)
+}
+
+// Releases a mount of this host
+func (volume *sharedVolume) releaseMount(mount *volumeMount) error {
+	if mount.ReadOnly {
+		if err := volume.unbindReadOnly(mount.MountID); err != nil {
+			log.Warnf("Failed to remove read-only mount %s of volume %s: %s", mount.MountID, volume.Name, err)
+		}
+	}
+
+	return locking.release(mount)
+}
+
+// Returns the path the container has to use for the mount
+func (volume *sharedVolume) GetMountpointFor(mount *volumeMount) string {
+	if mount.ReadOnly {
+		return volume.GetReaderDir(mount.MountID)
+	}
+	return volume.GetDataDir()
+}
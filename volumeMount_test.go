@@ -0,0 +1,111 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostExclusiveRemountOfTheFirstMountID(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		volume := createTestVolume(t, "data", volumeMetadata{HostExclusive: true})
+		for _, id := range []string{"c1", "c2"} {
+			if _, err := mountTestVolume(volume, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The container of the first mount restarts
+		if err := volume.unmount("c1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mountTestVolume(volume, "c1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := volume.unmount("c2"); err != nil {
+			t.Fatal(err)
+		}
+
+		mount, err := volume.loadMountFile(volume.getExclusiveMountFile())
+		if err != nil || mount == nil {
+			t.Fatalf("Mount was released while c1 still uses it: %v", err)
+		}
+		if !mount.hasMountID("c1") || mount.hasMountID("c2") {
+			t.Errorf("Mount is held for %v", mount.MountIDs)
+		}
+	})
+}
+
+func TestMaxMountsLimitsConcurrentMounts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		wait := false
+		volume := createTestVolume(t, "data", volumeMetadata{MaxMounts: 2, Wait: &wait})
+
+		for _, id := range []string{"c1", "c2"} {
+			if _, err := mountTestVolume(volume, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := mountTestVolume(volume, "c3"); err == nil {
+			t.Fatal("Mount exceeded the maximum number of mounts")
+		} else if _, ok := err.(*mountBusyError); !ok {
+			t.Fatal(err)
+		}
+
+		// A released slot is taken by the next mount
+		if err := volume.unmount("c1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mountTestVolume(volume, "c3"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRWSingleMountsOneWriter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Bind mounting the readers needs root")
+	}
+
+	forEachBackend(t, func(t *testing.T) {
+		volume := createTestVolume(t, "data", volumeMetadata{Mode: volumeModeRWSingle})
+
+		writer, err := mountTestVolume(volume, "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := mountTestVolume(volume, "c2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer volume.unmount("c2")
+
+		if writer.ReadOnly || !reader.ReadOnly {
+			t.Fatalf("Mounts c1 and c2 are read-only %t and %t", writer.ReadOnly, reader.ReadOnly)
+		}
+		if path := volume.GetMountpointFor(reader); path == volume.GetDataDir() {
+			t.Fatal("Reader uses the data directory of the writer")
+		}
+
+		// The reader sees the data of the writer, but cannot change it
+		if err = ioutil.WriteFile(filepath.Join(volume.GetDataDir(), "file"), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !exists(filepath.Join(volume.GetMountpointFor(reader), "file")) {
+			t.Error("Reader does not see the data of the writer")
+		}
+		if err = ioutil.WriteFile(filepath.Join(volume.GetMountpointFor(reader), "other"), []byte("data"), 0644); err == nil {
+			t.Error("Reader was able to write to the volume")
+		}
+
+		if err = volume.unmount("c2"); err != nil {
+			t.Fatal(err)
+		}
+		if exists(volume.GetReaderDir("c2")) {
+			t.Error("Read-only mount of the reader was not removed")
+		}
+	})
+}
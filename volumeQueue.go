@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Mounts waiting for a busy volume register a ticket in the queue directory.
+// Tickets are numbered in the order they were taken, and slots are handed out in ticket order.
+// A ticket has the same content as a mount file. Tickets that leave the queue are renamed
+// to .retired files, the highest of which is kept so numbers are never handed out twice.
+
+const (
+	// Attempts to take a ticket while others keep taking the same number
+	maxTicketAttempts   = 10
+	ticketRetryInterval = 10 * time.Millisecond
+)
+
+func (volume *sharedVolume) GetQueueDir() string {
+	return filepath.Join(volume.GetLocksDir(), "queue")
+}
+
+// Returns the sequence number of a ticket from its file name
+func ticketSequence(ticket *volumeMount) uint64 {
+	name := filepath.Base(ticket.LockFilePath)
+	sequence, _ := strconv.ParseUint(strings.TrimSuffix(name, ".ticket"), 10, 64)
+	return sequence
+}
+
+// Returns the tickets in the queue in order
+func (volume *sharedVolume) getQueue() []*volumeMount {
+	queueDir := volume.GetQueueDir()
+
+	files, err := fsReadDir(queueDir)
+	if err != nil {
+		return nil
+	}
+
+	tickets := []*volumeMount{}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".ticket" {
+			continue
+		}
+
+		if ticket, err := volume.loadMountFile(filepath.Join(queueDir, file.Name())); err == nil {
+			if ticket != nil {
+				tickets = append(tickets, ticket)
+			}
+		} else {
+			log.Errorf("Failed to read ticket %s of volume %s", file.Name(), volume.Name)
+		}
+	}
+
+	sort.Slice(tickets, func(i, j int) bool {
+		return ticketSequence(tickets[i]) < ticketSequence(tickets[j])
+	})
+
+	return tickets
+}
+
+// Takes a ticket for the mount at the end of the queue
+func (volume *sharedVolume) enqueue(mount *volumeMount) (*volumeMount, error) {
+	queueDir := volume.GetQueueDir()
+
+	if err := fsMkdirAll(queueDir, 0750); err != nil {
+		return nil, err
+	}
+
+	ticket := *mount
+	ticket.Epoch = 0
+
+	retry := newBackoff(ticketRetryInterval, maxTicketAttempts*ticketRetryInterval)
+
+	for attempt := 1; ; attempt++ {
+		sequence, err := volume.nextTicketSequence()
+		if err != nil {
+			return nil, err
+		}
+
+		ticket.LockFilePath = filepath.Join(queueDir, fmt.Sprintf("%020d.ticket", sequence))
+
+		// Someone else may take the same number, then try the next one
+		if err = ticket.save(); err == nil {
+			return &ticket, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if attempt == maxTicketAttempts {
+			return nil, fmt.Errorf("Gave up taking a ticket for volume %s after %d attempts", volume.Name, attempt)
+		}
+		time.Sleep(retry.delay())
+	}
+}
+
+// Returns the number after the highest ticket ever taken.
+// Retired tickets below the highest one are removed on the way.
+func (volume *sharedVolume) nextTicketSequence() (uint64, error) {
+	queueDir := volume.GetQueueDir()
+
+	files, err := fsReadDir(queueDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var next uint64
+	retired := make(map[string]uint64)
+
+	for _, file := range files {
+		name := file.Name()
+		extension := filepath.Ext(name)
+		if file.IsDir() || (extension != ".ticket" && extension != ".retired") {
+			continue
+		}
+
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, extension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if sequence >= next {
+			next = sequence + 1
+		}
+		if extension == ".retired" {
+			retired[name] = sequence
+		}
+	}
+
+	for name, sequence := range retired {
+		if sequence+1 < next {
+			fsRemove(filepath.Join(queueDir, name))
+		}
+	}
+
+	return next, nil
+}
+
+// Takes the ticket out of the queue
+func (volume *sharedVolume) retireTicket(ticket *volumeMount) {
+	observer.forget(ticket.LockFilePath)
+
+	retired := strings.TrimSuffix(ticket.LockFilePath, ".ticket") + ".retired"
+	if err := fsRename(ticket.LockFilePath, retired); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove ticket %s from the queue of volume %s: %s", ticket.MountID, volume.Name, err)
+	}
+}
+
+// Returns the number of live tickets ahead of the given one,
+// or of all live tickets if the mount has no ticket.
+// Tickets of hosts that are gone or restarted are removed on the way.
+func (volume *sharedVolume) queuePosition(ticket *volumeMount) int {
+	position := 0
+
+	for _, other := range volume.getQueue() {
+		if ticket != nil && other.LockFilePath == ticket.LockFilePath {
+			break
+		}
+
+		if volume.isTicketAbandoned(other) {
+			log.Infof("Removing abandoned ticket of mount %s on host %s from the queue of volume %s", other.MountID, other.Hostname, volume.Name)
+			volume.retireTicket(other)
+			continue
+		}
+
+		position++
+	}
+
+	return position
+}
+
+func (volume *sharedVolume) isTicketAbandoned(ticket *volumeMount) bool {
+	if ticket.Hostname == *hostname {
+		return ticket.owner().isPreviousIncarnation()
+	}
+
+	return !locking.isAlive(volume, ticket.Hostname)
+}
+
+// Describes the queue for inspection
+func (volume *sharedVolume) getQueueStatus() []string {
+	queue := []string{}
+
+	for _, ticket := range volume.getQueue() {
+		queue = append(queue, fmt.Sprintf("%s on host %s", ticket.MountID, ticket.Hostname))
+	}
+
+	return queue
+}
@@ -0,0 +1,144 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMountWithoutWaitRespectsQueue(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	wait := false
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, Wait: &wait})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mount of h2 is waiting for the volume
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+	if _, err := other.enqueue(other.newMount("c2")); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h1")
+	if err := volume.unmount("c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mountTestVolume(volume, "c3"); err == nil {
+		t.Fatal("Mount that does not wait skipped the queue")
+	}
+	if exists(volume.getExclusiveMountFile()) {
+		t.Fatal("Slot was taken ahead of the queue")
+	}
+}
+
+func TestTicketNumbersKeepIncreasing(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+
+	var previous uint64
+	for i := 0; i < 3; i++ {
+		ticket, err := volume.enqueue(volume.newMount("c1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sequence := ticketSequence(ticket)
+		if i > 0 && sequence <= previous {
+			t.Fatalf("Ticket %d was taken after ticket %d", sequence, previous)
+		}
+		previous = sequence
+
+		// The queue is empty again
+		volume.retireTicket(ticket)
+		if len(volume.getQueue()) != 0 {
+			t.Fatal("Retired ticket is still in the queue")
+		}
+	}
+
+	// Only the highest retired ticket is kept
+	retired, err := filepath.Glob(filepath.Join(volume.GetQueueDir(), "*.retired"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retired) > 2 {
+		t.Errorf("Retired tickets are not removed: %v", retired)
+	}
+}
+
+func TestEnqueueGivesUpWhenTheTicketIsAlwaysTaken(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true})
+
+	// Not counted as a ticket, so its number is handed out again and again
+	if err := os.MkdirAll(filepath.Join(volume.GetQueueDir(), fmt.Sprintf("%020d.ticket", 0)), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := volume.enqueue(volume.newMount("c1")); err == nil {
+		t.Fatal("Took a ticket that is taken")
+	}
+}
+
+func TestMountWaitPolicyOfTheVolume(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, MountTimeout: 1, MountRetry: 1})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h2")
+	other := attachTestVolume(t, "data")
+
+	started := time.Now()
+	if _, err := mountTestVolume(other, "c2"); err == nil {
+		t.Fatal("Mount of a busy volume succeeded")
+	}
+	if waited := time.Since(started); waited < time.Second || waited > lockTimeout/2 {
+		t.Errorf("Mount gave up after %s instead of the mount timeout of the volume", waited)
+	}
+
+	if len(other.getQueue()) != 0 {
+		t.Error("Mount that gave up is still queued")
+	}
+}
+
+func TestWaitingMountGivesUpOnShutdown(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	volume := createTestVolume(t, "data", volumeMetadata{Exclusive: true, MountTimeout: 60, MountRetry: 1})
+	if _, err := mountTestVolume(volume, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestHost(t, "h2")
+	driver := newTestDriver()
+	other := driver.addVolume(attachTestVolume(t, "data"))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(driver.stop)
+	}()
+
+	started := time.Now()
+	if _, err := mountTestVolume(other, "c2"); err == nil {
+		t.Fatal("Mount of a busy volume succeeded")
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Errorf("Mount gave up %s after the driver was stopped", waited)
+	}
+
+	if len(other.getQueue()) != 0 {
+		t.Error("Mount that gave up is still queued")
+	}
+}
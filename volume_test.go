@@ -0,0 +1,44 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRecreatedVolumeHasANewIdentity(t *testing.T) {
+	defer setupTestRoot(t, lockBackendFile)()
+
+	old := createTestVolume(t, "data", volumeMetadata{})
+	if old.UUID == "" || old.CreatedBy != "h1" {
+		t.Fatalf("Volume was created without identity: %+v", old.volumeMetadata)
+	}
+
+	// h2 removes the volume and creates it again, while h1 still holds it
+	setTestHost(t, "h2")
+	if err := os.RemoveAll(old.Mountpoint); err != nil {
+		t.Fatal(err)
+	}
+	recreated := createTestVolume(t, "data", volumeMetadata{})
+	if recreated.sameIdentity(old) {
+		t.Fatal("Recreated volume has the identity of the removed one")
+	}
+
+	setTestHost(t, "h1")
+	if err := old.lock(); err == nil {
+		t.Fatal("Removed volume was locked in place of the recreated one")
+	}
+
+	// A lock h1 wrote for the removed volume does not hold the new one
+	if err := old.writeLockFile(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := recreated.getLock("h1")
+	if err != nil || lock == nil {
+		t.Fatalf("Failed to read the lock: %v", err)
+	}
+	if !lock.released {
+		t.Error("Lock of the removed volume holds the recreated one")
+	}
+}